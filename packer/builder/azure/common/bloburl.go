@@ -0,0 +1,49 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// BlobURL holds the parts of an Azure storage blob URL like
+// https://account.blob.core.windows.net/container/path/blob.vhd
+type BlobURL struct {
+	StorageAccount string
+	EndpointSuffix string
+	Container      string
+	Blob           string
+}
+
+func ParseBlobURL(blobURL string) (BlobURL, error) {
+	var b BlobURL
+
+	u, err := url.Parse(blobURL)
+	if err != nil {
+		return b, err
+	}
+
+	i := strings.Index(u.Host, ".blob.")
+	if i <= 0 || i+6 == len(u.Host) {
+		return b, fmt.Errorf("%q is not a blob URL, host should be <account>.blob.<endpoint suffix>", blobURL)
+	}
+	b.StorageAccount = u.Host[:i]
+	b.EndpointSuffix = u.Host[i+6:]
+
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return b, fmt.Errorf("%q is not a blob URL, path should be /<container>/<blob>", blobURL)
+	}
+	b.Container = parts[0]
+	b.Blob = parts[1]
+
+	return b, nil
+}
+
+// URL returns the blob URL without any query string.
+func (b BlobURL) URL() string {
+	return fmt.Sprintf("https://%s.blob.%s/%s/%s", b.StorageAccount, b.EndpointSuffix, b.Container, b.Blob)
+}
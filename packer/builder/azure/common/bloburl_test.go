@@ -0,0 +1,38 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package common
+
+import (
+	"testing"
+)
+
+func TestParseBlobURL(t *testing.T) {
+	tests := []struct {
+		in  string
+		out BlobURL
+		err bool
+	}{
+		{in: "https://sa.blob.core.windows.net/vhds/disk.vhd", out: BlobURL{"sa", "core.windows.net", "vhds", "disk.vhd"}},
+		{in: "https://sa.blob.core.chinacloudapi.cn/vhds/a/b/disk.vhd?sv=x", out: BlobURL{"sa", "core.chinacloudapi.cn", "vhds", "a/b/disk.vhd"}},
+		{in: "https://sa.blob.core.windows.net/vhds", err: true},
+		{in: "https://sa.blob.core.windows.net/vhds/", err: true},
+		{in: "https://sa.table.core.windows.net/vhds/disk.vhd", err: true},
+		{in: "https://.blob.core.windows.net/vhds/disk.vhd", err: true},
+		{in: "://", err: true},
+	}
+
+	for _, tc := range tests {
+		b, err := ParseBlobURL(tc.in)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value for %q: %v", tc.in, err)
+		}
+		if err == nil && b != tc.out {
+			t.Errorf("expected %+v for %q, got %+v", tc.out, tc.in, b)
+		}
+	}
+
+	if b, _ := ParseBlobURL(tests[1].in); b.URL() != "https://sa.blob.core.chinacloudapi.cn/vhds/a/b/disk.vhd" {
+		t.Errorf("unexpected URL: %s", b.URL())
+	}
+}
@@ -17,8 +17,10 @@ const (
 	AuthorizedKey         string = "authorizedKey"
 	Certificate           string = "certificate"
 	Config                string = "config"
+	DataDisks             string = "dataDisks"
 	Error                 string = "error"
 	HardDiskName          string = "hardDiskName"
+	Journal               string = "journal"
 	MediaLink             string = "mediaLink"
 	OSImageName           string = "osImageName"
 	PrivateKey            string = "privateKey"
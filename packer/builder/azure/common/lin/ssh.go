@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
 	"github.com/mitchellh/multistep"
+	packerssh "github.com/mitchellh/packer/communicator/ssh"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -17,8 +18,8 @@ func SSHHost(state multistep.StateBag) (string, error) {
 
 // SSHConfig returns a function that can be used for the SSH communicator
 // config for connecting to the instance created over SSH using the generated
-// private key.
-func SSHConfig(username string) func(multistep.StateBag) (*ssh.ClientConfig, error) {
+// private key, and the password if one is given.
+func SSHConfig(username, password string) func(multistep.StateBag) (*ssh.ClientConfig, error) {
 	return func(state multistep.StateBag) (*ssh.ClientConfig, error) {
 		privateKey := state.Get(constants.PrivateKey).(string)
 
@@ -27,11 +28,18 @@ func SSHConfig(username string) func(multistep.StateBag) (*ssh.ClientConfig, err
 			return nil, fmt.Errorf("Error setting up SSH config: %s", err)
 		}
 
+		auth := []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		}
+		if password != "" {
+			auth = append(auth,
+				ssh.Password(password),
+				ssh.KeyboardInteractive(packerssh.PasswordKeyboardInteractive(password)))
+		}
+
 		return &ssh.ClientConfig{
 			User: username,
-			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
-			},
+			Auth: auth,
 		}, nil
 	}
 }
@@ -11,6 +11,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"time"
@@ -23,6 +24,14 @@ import (
 
 type StepCreateCert struct {
 	TmpServiceName string
+
+	// PrivateKeyFile is a PEM encoded RSA private key to use instead of a
+	// newly generated one.
+	PrivateKeyFile string
+
+	// Debug writes the generated private key to DebugKeyPath.
+	Debug        bool
+	DebugKeyPath string
 }
 
 func (s *StepCreateCert) Run(state multistep.StateBag) multistep.StepAction {
@@ -38,6 +47,17 @@ func (s *StepCreateCert) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
+	if s.Debug && s.PrivateKeyFile == "" {
+		ui.Message(fmt.Sprintf("Saving key for debug purposes: %s", s.DebugKeyPath))
+		privateKey := state.Get(constants.PrivateKey).(string)
+		if err := ioutil.WriteFile(s.DebugKeyPath, []byte(privateKey), 0600); err != nil {
+			err := fmt.Errorf("Error saving debug key: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	return multistep.ActionContinue
 }
 
@@ -45,12 +65,24 @@ func (s *StepCreateCert) Cleanup(state multistep.StateBag) {}
 
 func (s *StepCreateCert) createCert(state multistep.StateBag) error {
 
-	log.Printf("createCert: Generating RSA key pair...")
-
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		err := fmt.Errorf("Failed to Generate Private Key: %s", err)
-		return err
+	var priv *rsa.PrivateKey
+	var err error
+	if s.PrivateKeyFile != "" {
+		log.Printf("createCert: Reading RSA private key from %s...", s.PrivateKeyFile)
+
+		priv, err = readPrivateKey(s.PrivateKeyFile)
+		if err != nil {
+			err := fmt.Errorf("Failed to Read Private Key: %s", err)
+			return err
+		}
+	} else {
+		log.Printf("createCert: Generating RSA key pair...")
+
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			err := fmt.Errorf("Failed to Generate Private Key: %s", err)
+			return err
+		}
 	}
 
 	// ASN.1 DER encoded form
@@ -112,3 +144,33 @@ func (s *StepCreateCert) createCert(state multistep.StateBag) error {
 
 	return nil
 }
+
+// readPrivateKey reads a PEM encoded RSA private key in PKCS#1 or PKCS#8
+// form. Azure only accepts RSA keys for the SSH certificate.
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", path)
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		return nil, fmt.Errorf("%s is encrypted, encrypted keys are not supported", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not contain an RSA private key: %s", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an RSA private key but a %T", path, key)
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package lin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+func writeKeyFile(t *testing.T, blockType string, der []byte) string {
+	f, err := ioutil.TempFile("", "packer-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestReadPrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		blockType string
+		der       []byte
+		err       bool
+	}{
+		{"RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), false},
+		{"PRIVATE KEY", pkcs8, false},
+		{"PRIVATE KEY", ecPkcs8, true},
+		{"RSA PRIVATE KEY", []byte("garbage"), true},
+	}
+
+	for _, tc := range tcs {
+		path := writeKeyFile(t, tc.blockType, tc.der)
+		defer os.Remove(path)
+
+		key, err := readPrivateKey(path)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value for %s: %v", tc.blockType, err)
+		}
+		if err == nil && key.N.Cmp(rsaKey.N) != 0 {
+			t.Errorf("read key does not match written key")
+		}
+	}
+}
+
+func TestStepCreateCert_PrivateKeyFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeKeyFile(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	defer os.Remove(path)
+
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{Writer: ioutil.Discard, ErrorWriter: ioutil.Discard})
+
+	step := &StepCreateCert{TmpServiceName: "service", PrivateKeyFile: path}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("unexpected action %v: %v", action, state.Get("error"))
+	}
+
+	privateKey := state.Get(constants.PrivateKey).(string)
+	block, _ := pem.Decode([]byte(privateKey))
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.N.Cmp(rsaKey.N) != 0 {
+		t.Errorf("private key in state does not match the key file")
+	}
+	if thumbprint := state.Get(constants.Thumbprint).(string); len(thumbprint) != 40 {
+		t.Errorf("unexpected thumbprint %q", thumbprint)
+	}
+}
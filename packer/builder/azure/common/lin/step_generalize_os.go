@@ -9,30 +9,133 @@ import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	"log"
+	"strings"
 )
 
+// findAgentCommand prints the path of the Azure Linux Agent, the locations
+// differ between distributions and agent versions.
+const findAgentCommand = `for p in "$(command -v waagent)" /usr/sbin/waagent /usr/local/sbin/waagent /usr/bin/waagent /usr/local/bin/waagent; do if [ -x "$p" ]; then echo "$p"; exit 0; fi; done; exit 1`
+
+// DefaultDeprovisionCommand returns the generalization command for the agent
+// at agentPath.
+func DefaultDeprovisionCommand(agentPath string) string {
+	return fmt.Sprintf("sudo %s -force -deprovision+user && export HISTSIZE=0 && sync", agentPath)
+}
+
 type StepGeneralizeOS struct {
+	// Command generalizes the OS, DefaultDeprovisionCommand is used with the
+	// agent that was found if it is empty.
 	Command string
+
+	// PreCommands are run before the agent check and the generalization,
+	// e.g. to truncate logs.
+	PreCommands []string
+
+	// SkipDeprovision only runs the PreCommands.
+	SkipDeprovision bool
 }
 
 func (s *StepGeneralizeOS) Run(state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
 	comm := state.Get("communicator").(packer.Communicator)
 
+	halt := func(err error) multistep.StepAction {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	for _, command := range s.PreCommands {
+		ui.Say(fmt.Sprintf("Executing pre-generalization command: %s", command))
+		if err := runCommand(comm, command, fmt.Sprintf("pre-generalization command %q", command)); err != nil {
+			return halt(err)
+		}
+	}
+
+	if s.SkipDeprovision {
+		ui.Say("Skipping OS generalization...")
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Checking Azure Linux Agent...")
+	agentPath, version, err := findAgent(comm)
+	if err != nil {
+		if s.Command == "" {
+			return halt(fmt.Errorf("Azure Linux Agent not found, set deprovision_command or skip_deprovision: %s", err))
+		}
+		ui.Message(fmt.Sprintf("Azure Linux Agent not found: %s", err))
+	} else {
+		ui.Message(fmt.Sprintf("Azure Linux Agent: %s (%s)", agentPath, version))
+	}
+
+	command := s.Command
+	if command == "" {
+		command = DefaultDeprovisionCommand(agentPath)
+	}
+
 	ui.Say("Executing OS generalization...")
+	if err := runCommand(comm, command, "OS generalization command"); err != nil {
+		return halt(err)
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepGeneralizeOS) Cleanup(state multistep.StateBag) {
+	// do nothing
+}
+
+// findAgent returns the path and the version of the Azure Linux Agent.
+func findAgent(comm packer.Communicator) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: findAgentCommand,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	if err := comm.Start(cmd); err != nil {
+		return "", "", err
+	}
+	cmd.Wait()
+	if cmd.ExitStatus != 0 {
+		return "", "", fmt.Errorf("waagent is not in the PATH nor in a known location")
+	}
+	agentPath := strings.TrimSpace(stdout.String())
 
+	stdout.Reset()
+	stderr.Reset()
+	cmd = &packer.RemoteCmd{
+		Command: agentPath + " -version",
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	if err := comm.Start(cmd); err != nil {
+		return "", "", err
+	}
+	cmd.Wait()
+	if cmd.ExitStatus != 0 {
+		return "", "", fmt.Errorf("%s -version has non-zero exit status: %s", agentPath, stderr.String())
+	}
+
+	version := strings.TrimSpace(stdout.String())
+	if i := strings.Index(version, "\n"); i >= 0 {
+		version = version[:i]
+	}
+	return agentPath, version, nil
+}
+
+// runCommand runs command and returns an error described by name if it
+// fails.
+func runCommand(comm packer.Communicator, command, name string) error {
 	var stdout, stderr bytes.Buffer
 	cmd := &packer.RemoteCmd{
-		Command: s.Command,
+		Command: command,
 		Stdout:  &stdout,
 		Stderr:  &stderr,
 	}
 
 	if err := comm.Start(cmd); err != nil {
-		err := fmt.Errorf("Failed executing OS generalization command: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
+		return fmt.Errorf("Failed executing %s: %s", name, err)
 	}
 
 	// Wait for the command to run
@@ -40,18 +143,13 @@ func (s *StepGeneralizeOS) Run(state multistep.StateBag) multistep.StepAction {
 
 	// If the command failed to run, notify the user in some way.
 	if cmd.ExitStatus != 0 {
-		state.Put("error", fmt.Errorf(
-			"OS generalization has non-zero exit status.\n\nStdout: %s\n\nStderr: %s",
-			stdout.String(), stderr.String()))
-		return multistep.ActionHalt
+		return fmt.Errorf(
+			"%s has non-zero exit status.\n\nStdout: %s\n\nStderr: %s",
+			name, stdout.String(), stderr.String())
 	}
 
-	log.Printf("OS generalization stdout: %s", stdout.String())
-	log.Printf("OS generalization stderr: %s", stderr.String())
+	log.Printf("%s stdout: %s", name, stdout.String())
+	log.Printf("%s stderr: %s", name, stderr.String())
 
-	return multistep.ActionContinue
-}
-
-func (s *StepGeneralizeOS) Cleanup(state multistep.StateBag) {
-	// do nothing
+	return nil
 }
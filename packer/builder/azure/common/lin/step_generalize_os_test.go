@@ -0,0 +1,119 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package lin
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// fakeComm answers commands with the output and exit status of the first
+// entry in responses whose key is a prefix of the command.
+type fakeComm struct {
+	responses map[string]fakeResponse
+	commands  []string
+}
+
+type fakeResponse struct {
+	stdout     string
+	exitStatus int
+}
+
+func (c *fakeComm) Start(cmd *packer.RemoteCmd) error {
+	c.commands = append(c.commands, cmd.Command)
+	go func() {
+		for prefix, r := range c.responses {
+			if strings.HasPrefix(cmd.Command, prefix) {
+				if cmd.Stdout != nil {
+					io.WriteString(cmd.Stdout, r.stdout)
+				}
+				cmd.SetExited(r.exitStatus)
+				return
+			}
+		}
+		cmd.SetExited(0)
+	}()
+	return nil
+}
+
+func (c *fakeComm) Upload(string, io.Reader, *os.FileInfo) error { return nil }
+func (c *fakeComm) UploadDir(string, string, []string) error     { return nil }
+func (c *fakeComm) Download(string, io.Writer) error             { return nil }
+func (c *fakeComm) DownloadDir(string, string, []string) error   { return nil }
+
+func runGeneralize(t *testing.T, step *StepGeneralizeOS, comm *fakeComm) multistep.StepAction {
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{Writer: ioutil.Discard, ErrorWriter: ioutil.Discard})
+	state.Put("communicator", comm)
+	return step.Run(state)
+}
+
+func TestStepGeneralizeOS_DefaultCommand(t *testing.T) {
+	comm := &fakeComm{responses: map[string]fakeResponse{
+		findAgentCommand:                   {stdout: "/usr/local/sbin/waagent\n"},
+		"/usr/local/sbin/waagent -version": {stdout: "WALinuxAgent-2.0.16 running on freebsd 10.2\nPython: 2.7.10\n"},
+	}}
+
+	step := &StepGeneralizeOS{PreCommands: []string{"sudo truncate -s 0 /var/log/messages"}}
+	if action := runGeneralize(t, step, comm); action != multistep.ActionContinue {
+		t.Fatalf("unexpected action %v", action)
+	}
+
+	expected := []string{
+		"sudo truncate -s 0 /var/log/messages",
+		findAgentCommand,
+		"/usr/local/sbin/waagent -version",
+		DefaultDeprovisionCommand("/usr/local/sbin/waagent"),
+	}
+	if strings.Join(comm.commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected commands %q, got %q", expected, comm.commands)
+	}
+}
+
+func TestStepGeneralizeOS_AgentNotFound(t *testing.T) {
+	newComm := func() *fakeComm {
+		return &fakeComm{responses: map[string]fakeResponse{
+			findAgentCommand: {exitStatus: 1},
+		}}
+	}
+
+	if action := runGeneralize(t, &StepGeneralizeOS{}, newComm()); action != multistep.ActionHalt {
+		t.Errorf("expected the default command to require the agent")
+	}
+
+	comm := newComm()
+	if action := runGeneralize(t, &StepGeneralizeOS{Command: "deprovision"}, comm); action != multistep.ActionContinue {
+		t.Errorf("expected a custom command to not require the agent")
+	}
+	if last := comm.commands[len(comm.commands)-1]; last != "deprovision" {
+		t.Errorf("expected custom command to run, got %q", last)
+	}
+
+	comm = newComm()
+	if action := runGeneralize(t, &StepGeneralizeOS{SkipDeprovision: true}, comm); action != multistep.ActionContinue {
+		t.Errorf("unexpected action %v", action)
+	}
+	if len(comm.commands) != 0 {
+		t.Errorf("expected no commands, got %q", comm.commands)
+	}
+}
+
+func TestStepGeneralizeOS_PreCommandFails(t *testing.T) {
+	comm := &fakeComm{responses: map[string]fakeResponse{
+		"false": {exitStatus: 1},
+	}}
+
+	if action := runGeneralize(t, &StepGeneralizeOS{PreCommands: []string{"false", "true"}}, comm); action != multistep.ActionHalt {
+		t.Errorf("unexpected action %v", action)
+	}
+	if len(comm.commands) != 1 {
+		t.Errorf("expected to stop after the failing command, got %q", comm.commands)
+	}
+}
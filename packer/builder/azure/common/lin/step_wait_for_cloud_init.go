@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package lin
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"time"
+)
+
+// cloudInitFinishedCommand succeeds once cloud-init has completed the final
+// stage of the first boot.
+const cloudInitFinishedCommand = "test -f /var/lib/cloud/instance/boot-finished"
+
+type StepWaitForCloudInit struct {
+	Timeout time.Duration
+}
+
+func (s *StepWaitForCloudInit) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	comm := state.Get("communicator").(packer.Communicator)
+
+	ui.Say("Waiting for cloud-init to finish...")
+
+	const pollInterval = 10 * time.Second
+	for deadline := time.Now().Add(s.Timeout); ; {
+		var stdout, stderr bytes.Buffer
+		cmd := &packer.RemoteCmd{
+			Command: cloudInitFinishedCommand,
+			Stdout:  &stdout,
+			Stderr:  &stderr,
+		}
+
+		if err := comm.Start(cmd); err != nil {
+			err := fmt.Errorf("Failed checking cloud-init status: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		cmd.Wait()
+
+		if cmd.ExitStatus == 0 {
+			break
+		}
+		log.Printf("cloud-init not finished yet (exit status %d): %s", cmd.ExitStatus, stderr.String())
+
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("cloud-init did not finish within %s", s.Timeout)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		if _, ok := state.GetOk(multistep.StateCancelled); ok {
+			return multistep.ActionHalt
+		}
+
+		time.Sleep(pollInterval)
+	}
+
+	ui.Message("cloud-init finished")
+	return multistep.ActionContinue
+}
+
+func (s *StepWaitForCloudInit) Cleanup(state multistep.StateBag) {
+	// do nothing
+}
@@ -9,3 +9,9 @@ func IsStateCancelled(stateBag multistep.StateBag) bool {
 	_, ok := stateBag.GetOk(multistep.StateCancelled)
 	return ok
 }
+
+// IsStateFailed returns true if the build was halted by a step or cancelled.
+func IsStateFailed(stateBag multistep.StateBag) bool {
+	_, halted := stateBag.GetOk(multistep.StateHalted)
+	return halted || IsStateCancelled(stateBag)
+}
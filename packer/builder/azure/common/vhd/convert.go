@@ -0,0 +1,359 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package vhd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	dynamicHeaderCookie      = "cxsparse"
+	dynamicHeaderSize        = 1024
+	dynamicHeaderChecksumPos = 36
+	unusedBlock              = 0xFFFFFFFF
+	copyBufferSize           = MiB
+)
+
+// dynamicHeader holds the fields of the dynamic disk header that are needed
+// to read the blocks of a dynamic VHD.
+type dynamicHeader struct {
+	Cookie          [8]byte
+	DataOffset      uint64
+	TableOffset     uint64
+	HeaderVersion   uint32
+	MaxTableEntries uint32
+	BlockSize       uint32
+	Checksum        uint32
+}
+
+// Format describes what kind of image a file is.
+type Format int
+
+const (
+	FormatRaw Format = iota
+	FormatFixed
+	FormatDynamic
+	FormatDifferencing
+)
+
+// Inspect returns the format of the image at path and, for VHDs, the footer.
+// Files without a footer cookie are treated as raw disk images.
+func Inspect(path string) (Format, *Footer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FormatRaw, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return FormatRaw, nil, err
+	}
+
+	if fi.Size() < FooterSize {
+		return FormatRaw, nil, nil
+	}
+	b := make([]byte, FooterSize)
+	if _, err := f.ReadAt(b, fi.Size()-FooterSize); err != nil {
+		return FormatRaw, nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(footerCookie)) {
+		return FormatRaw, nil, nil
+	}
+	footer, err := ParseFooter(b)
+	if err != nil {
+		return FormatRaw, nil, err
+	}
+
+	switch footer.DiskType {
+	case DiskTypeFixed:
+		if uint64(fi.Size()) != footer.CurrentSize+FooterSize {
+			return FormatFixed, footer, fmt.Errorf("file size %d does not match fixed VHD size %d", fi.Size(), footer.CurrentSize+FooterSize)
+		}
+		return FormatFixed, footer, nil
+	case DiskTypeDynamic:
+		return FormatDynamic, footer, nil
+	case DiskTypeDifferencing:
+		return FormatDifferencing, footer, nil
+	default:
+		return FormatRaw, footer, fmt.Errorf("unknown disk type %d", footer.DiskType)
+	}
+}
+
+// VirtualSize returns the virtual size of the disk at path once it is
+// converted for Azure: the size in the footer of a VHD or the size of a raw
+// image, rounded up to a whole number of MiB.
+func VirtualSize(path string) (int64, error) {
+	format, footer, err := Inspect(path)
+	if err != nil {
+		return 0, err
+	}
+	if format == FormatRaw {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return alignedSize(fi.Size()), nil
+	}
+	return alignedSize(int64(footer.CurrentSize)), nil
+}
+
+// ConvertRawToFixed writes the raw disk image at src as a fixed VHD to dst,
+// padding the virtual size to a whole number of MiB.
+func ConvertRawToFixed(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeFixed(dst, fi.Size(), func(out io.WriterAt) error {
+		return copySparse(out, in, fi.Size())
+	})
+}
+
+// ConvertDynamicToFixed writes the dynamic VHD at src as a fixed VHD to dst,
+// padding the virtual size to a whole number of MiB.
+func ConvertDynamicToFixed(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	footer, err := ReadFooter(in, fi.Size())
+	if err != nil {
+		return err
+	}
+	if footer.DiskType != DiskTypeDynamic {
+		return fmt.Errorf("disk type is %s, expected dynamic", diskTypeName(footer.DiskType))
+	}
+
+	header, err := readDynamicHeader(in, int64(footer.DataOffset))
+	if err != nil {
+		return err
+	}
+
+	bat := make([]uint32, header.MaxTableEntries)
+	if err := binary.Read(io.NewSectionReader(in, int64(header.TableOffset), int64(len(bat))*4), binary.BigEndian, bat); err != nil {
+		return fmt.Errorf("error reading block allocation table: %v", err)
+	}
+
+	size := int64(footer.CurrentSize)
+	return writeFixed(dst, size, func(out io.WriterAt) error {
+		return copyDynamicBlocks(out, in, header, bat, size)
+	})
+}
+
+// ConvertToFixed converts the image at src to a fixed VHD at dst that Azure
+// accepts. src can be a raw disk image, a dynamic VHD or a fixed VHD with a
+// virtual size that is not a whole number of MiB.
+func ConvertToFixed(src, dst string) error {
+	format, footer, err := Inspect(src)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatRaw:
+		return ConvertRawToFixed(src, dst)
+	case FormatDynamic:
+		return ConvertDynamicToFixed(src, dst)
+	case FormatFixed:
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		size := int64(footer.CurrentSize)
+		return writeFixed(dst, size, func(out io.WriterAt) error {
+			return copySparse(out, in, size)
+		})
+	default:
+		return fmt.Errorf("cannot convert a %s VHD, merge it with its parent first", diskTypeName(footer.DiskType))
+	}
+}
+
+// alignedSize rounds size up to a whole number of MiB.
+func alignedSize(size int64) int64 {
+	return (size + MiB - 1) / MiB * MiB
+}
+
+// writeFixed creates a sparse fixed VHD at dst, copyData writes the disk
+// contents.
+func writeFixed(dst string, size int64, copyData func(io.WriterAt) error) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	virtualSize := alignedSize(size)
+	if err := out.Truncate(virtualSize); err != nil {
+		return err
+	}
+	if err := copyData(out); err != nil {
+		return err
+	}
+	if _, err := out.WriteAt(NewFixedFooter(virtualSize).Bytes(), virtualSize); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// copySparse copies size bytes from in to out, skipping all-zero ranges so
+// that out stays sparse.
+func copySparse(out io.WriterAt, in io.ReaderAt, size int64) error {
+	buf := make([]byte, copyBufferSize)
+	for offset := int64(0); offset < size; offset += int64(len(buf)) {
+		if remaining := size - offset; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		if _, err := in.ReadAt(buf, offset); err != nil {
+			return err
+		}
+		if err := writeNonZero(out, buf, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyDynamicBlocks(out io.WriterAt, in io.ReaderAt, header *dynamicHeader, bat []uint32, size int64) error {
+	blockSize := int64(header.BlockSize)
+	sectorsPerBlock := blockSize / SectorSize
+	bitmapSize := (sectorsPerBlock/8 + SectorSize - 1) / SectorSize * SectorSize
+
+	bitmap := make([]byte, bitmapSize)
+	block := make([]byte, blockSize)
+
+	for i, sector := range bat {
+		if sector == unusedBlock {
+			continue
+		}
+		offset := int64(i) * blockSize
+		if offset >= size {
+			return fmt.Errorf("block %d is beyond the virtual size of the disk", i)
+		}
+
+		blockStart := int64(sector) * SectorSize
+		if _, err := in.ReadAt(bitmap, blockStart); err != nil {
+			return fmt.Errorf("error reading bitmap of block %d: %v", i, err)
+		}
+		if _, err := in.ReadAt(block, blockStart+bitmapSize); err != nil {
+			return fmt.Errorf("error reading block %d: %v", i, err)
+		}
+
+		// sectors that are not marked in the bitmap contain no data
+		for s := int64(0); s < sectorsPerBlock; s++ {
+			if bitmap[s/8]&(0x80>>uint(s%8)) == 0 {
+				copy(block[s*SectorSize:(s+1)*SectorSize], make([]byte, SectorSize))
+			}
+		}
+
+		data := block
+		if offset+blockSize > size {
+			data = block[:size-offset]
+		}
+		if err := writeNonZero(out, data, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNonZero writes the sectors of buf that contain data to out at offset.
+func writeNonZero(out io.WriterAt, buf []byte, offset int64) error {
+	for start := 0; start < len(buf); start += SectorSize {
+		end := start + SectorSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if isZero(buf[start:end]) {
+			continue
+		}
+		// extend the write over following sectors with data
+		for end < len(buf) {
+			next := end + SectorSize
+			if next > len(buf) {
+				next = len(buf)
+			}
+			if isZero(buf[end:next]) {
+				break
+			}
+			end = next
+		}
+		if _, err := out.WriteAt(buf[start:end], offset+int64(start)); err != nil {
+			return err
+		}
+		start = end - SectorSize
+	}
+	return nil
+}
+
+func readDynamicHeader(r io.ReaderAt, offset int64) (*dynamicHeader, error) {
+	b := make([]byte, dynamicHeaderSize)
+	if _, err := r.ReadAt(b, offset); err != nil {
+		return nil, fmt.Errorf("error reading dynamic disk header: %v", err)
+	}
+
+	h := &dynamicHeader{}
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, h); err != nil {
+		return nil, err
+	}
+	if string(h.Cookie[:]) != dynamicHeaderCookie {
+		return nil, fmt.Errorf("invalid dynamic disk header cookie %q", h.Cookie[:])
+	}
+	if checksum := checksum(b, dynamicHeaderChecksumPos); checksum != h.Checksum {
+		return nil, fmt.Errorf("invalid dynamic disk header checksum %#08x, expected %#08x", h.Checksum, checksum)
+	}
+	if h.BlockSize == 0 || h.BlockSize%SectorSize != 0 {
+		return nil, fmt.Errorf("invalid block size %d", h.BlockSize)
+	}
+	return h, nil
+}
+
+// checksum returns the one's complement of the sum of all bytes of b
+// without the 4 byte checksum field at checksumPos.
+func checksum(b []byte, checksumPos int) uint32 {
+	var sum uint32
+	for i, v := range b {
+		if i >= checksumPos && i < checksumPos+4 {
+			continue
+		}
+		sum += uint32(v)
+	}
+	return ^sum
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func randomUUID() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return b
+}
@@ -0,0 +1,182 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+// Package vhd reads, validates and converts Virtual Hard Disk images so that
+// they can be used in Azure, which only accepts fixed VHDs with a virtual
+// size that is a whole number of MiB.
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	FooterSize = 512
+	SectorSize = 512
+	MiB        = 1024 * 1024
+
+	DiskTypeFixed        uint32 = 2
+	DiskTypeDynamic      uint32 = 3
+	DiskTypeDifferencing uint32 = 4
+)
+
+const (
+	footerCookie      = "conectix"
+	footerFeatures    = 0x00000002
+	footerVersion     = 0x00010000
+	fixedDataOffset   = 0xFFFFFFFFFFFFFFFF
+	footerChecksumPos = 64
+)
+
+// vhdEpoch is the reference of VHD timestamps.
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Footer is the 512 byte structure at the end of every VHD file, see the
+// Virtual Hard Disk Image Format Specification.
+type Footer struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	Timestamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// NewFixedFooter returns the footer of a fixed VHD with a virtual size of
+// size bytes.
+func NewFixedFooter(size int64) *Footer {
+	f := &Footer{
+		Features:          footerFeatures,
+		FileFormatVersion: footerVersion,
+		DataOffset:        fixedDataOffset,
+		Timestamp:         uint32(time.Now().Sub(vhdEpoch) / time.Second),
+		CreatorVersion:    0x00010000,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          DiskTypeFixed,
+	}
+	copy(f.Cookie[:], footerCookie)
+	copy(f.CreatorApplication[:], "pkr ")
+	copy(f.CreatorHostOS[:], "Wi2k")
+	f.Cylinders, f.Heads, f.SectorsPerTrack = geometry(size)
+	copy(f.UniqueID[:], randomUUID())
+	f.Checksum = f.computeChecksum()
+	return f
+}
+
+// ParseFooter parses and checks the cookie and checksum of a footer.
+func ParseFooter(b []byte) (*Footer, error) {
+	if len(b) != FooterSize {
+		return nil, fmt.Errorf("footer has %d bytes, expected %d", len(b), FooterSize)
+	}
+
+	f := &Footer{}
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, f); err != nil {
+		return nil, err
+	}
+	if string(f.Cookie[:]) != footerCookie {
+		return nil, fmt.Errorf("invalid footer cookie %q, not a VHD", f.Cookie[:])
+	}
+	if checksum := f.computeChecksum(); checksum != f.Checksum {
+		return nil, fmt.Errorf("invalid footer checksum %#08x, expected %#08x", f.Checksum, checksum)
+	}
+	return f, nil
+}
+
+// ReadFooter reads the footer at the end of a VHD of size bytes.
+func ReadFooter(r io.ReaderAt, size int64) (*Footer, error) {
+	if size < FooterSize {
+		return nil, fmt.Errorf("file of %d bytes is too small to be a VHD", size)
+	}
+	b := make([]byte, FooterSize)
+	if _, err := r.ReadAt(b, size-FooterSize); err != nil {
+		return nil, err
+	}
+	return ParseFooter(b)
+}
+
+// Bytes returns the binary representation of the footer.
+func (f *Footer) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, f)
+	return buf.Bytes()
+}
+
+// Validate checks that the footer describes a VHD that Azure accepts: a
+// fixed VHD with a virtual size that is a whole number of MiB.
+func (f *Footer) Validate() error {
+	if f.DiskType != DiskTypeFixed {
+		return fmt.Errorf("disk type is %s, Azure only supports fixed VHDs", diskTypeName(f.DiskType))
+	}
+	if f.CurrentSize == 0 || f.CurrentSize%MiB != 0 {
+		return fmt.Errorf("virtual size of %d bytes is not a whole number of MiB", f.CurrentSize)
+	}
+	return nil
+}
+
+func (f *Footer) computeChecksum() uint32 {
+	return checksum(f.Bytes(), footerChecksumPos)
+}
+
+func diskTypeName(diskType uint32) string {
+	switch diskType {
+	case DiskTypeFixed:
+		return "fixed"
+	case DiskTypeDynamic:
+		return "dynamic"
+	case DiskTypeDifferencing:
+		return "differencing"
+	default:
+		return fmt.Sprintf("unknown (%d)", diskType)
+	}
+}
+
+// geometry calculates the CHS geometry of a disk as described in appendix
+// A of the specification.
+func geometry(size int64) (cylinders uint16, heads uint8, sectorsPerTrack uint8) {
+	totalSectors := size / SectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	var spt, hds, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		hds = 16
+		cylinderTimesHeads = totalSectors / spt
+	} else {
+		spt = 17
+		cylinderTimesHeads = totalSectors / spt
+		hds = (cylinderTimesHeads + 1023) / 1024
+		if hds < 4 {
+			hds = 4
+		}
+		if cylinderTimesHeads >= hds*1024 || hds > 16 {
+			spt = 31
+			hds = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+		if cylinderTimesHeads >= hds*1024 {
+			spt = 63
+			hds = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+	}
+	return uint16(cylinderTimesHeads / hds), uint8(hds), uint8(spt)
+}
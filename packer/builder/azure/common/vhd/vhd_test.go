@@ -0,0 +1,217 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFooter_RoundTrip(t *testing.T) {
+	footer := NewFixedFooter(30 * 1024 * MiB)
+	b := footer.Bytes()
+	if len(b) != FooterSize {
+		t.Fatalf("footer has %d bytes, expected %d", len(b), FooterSize)
+	}
+
+	parsed, err := ParseFooter(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *parsed != *footer {
+		t.Fatalf("parsed footer does not match: %+v", parsed)
+	}
+	if err := parsed.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if parsed.Cylinders != 62415 || parsed.Heads != 16 || parsed.SectorsPerTrack != 63 {
+		t.Fatalf("unexpected geometry %d/%d/%d", parsed.Cylinders, parsed.Heads, parsed.SectorsPerTrack)
+	}
+
+	b[100] = 1
+	if _, err := ParseFooter(b); err == nil {
+		t.Fatalf("expected checksum error")
+	}
+	b[0] = 'x'
+	if _, err := ParseFooter(b); err == nil {
+		t.Fatalf("expected cookie error")
+	}
+}
+
+func TestFooter_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		footer *Footer
+		valid  bool
+	}{
+		{NewFixedFooter(MiB), true},
+		{NewFixedFooter(MiB + SectorSize), false},
+		{&Footer{DiskType: DiskTypeDynamic, CurrentSize: MiB}, false},
+	} {
+		if err := tc.footer.Validate(); (err == nil) != tc.valid {
+			t.Errorf("footer %+v: unexpected validation result %v", tc.footer, err)
+		}
+	}
+}
+
+func TestConvertRawToFixed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	raw := make([]byte, 3*SectorSize+100)
+	raw[0] = 1
+	raw[len(raw)-1] = 2
+	src := filepath.Join(dir, "disk.raw")
+	dst := filepath.Join(dir, "disk.vhd")
+	if err := ioutil.WriteFile(src, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if format, _, err := Inspect(src); err != nil || format != FormatRaw {
+		t.Fatalf("expected raw format, got %v %v", format, err)
+	}
+	if err := ConvertToFixed(src, dst); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d := checkFixed(t, dst, MiB)
+	if !bytes.Equal(d[:len(raw)], raw) || !isZero(d[len(raw):MiB]) {
+		t.Fatalf("converted disk contents do not match")
+	}
+}
+
+const (
+	testBlockSize   = 8 * SectorSize
+	testDynamicSize = 3 * testBlockSize
+)
+
+func TestConvertDynamicToFixed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "dynamic.vhd")
+	dst := filepath.Join(dir, "fixed.vhd")
+	block := writeDynamicVhd(t, src)
+
+	if format, _, err := Inspect(src); err != nil || format != FormatDynamic {
+		t.Fatalf("expected dynamic format, got %v %v", format, err)
+	}
+	if err := ConvertToFixed(src, dst); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d := checkFixed(t, dst, MiB)
+	expected := make([]byte, MiB)
+	copy(expected[testBlockSize:], block[:2*SectorSize])
+	if !bytes.Equal(d[:MiB], expected) {
+		t.Fatalf("converted disk contents do not match")
+	}
+}
+
+func TestVirtualSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dynamic := filepath.Join(dir, "dynamic.vhd")
+	writeDynamicVhd(t, dynamic)
+	raw := filepath.Join(dir, "disk.raw")
+	if err := ioutil.WriteFile(raw, make([]byte, MiB+SectorSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path     string
+		expected int64
+	}{
+		{dynamic, MiB}, // the virtual size of 3 blocks is aligned, the file is smaller
+		{raw, 2 * MiB},
+	} {
+		size, err := VirtualSize(tc.path)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", tc.path, err)
+		}
+		if size != tc.expected {
+			t.Errorf("virtual size of %s is %d, expected %d", tc.path, size, tc.expected)
+		}
+	}
+
+	if fi, err := os.Stat(dynamic); err != nil || fi.Size() >= testDynamicSize {
+		t.Fatalf("expected the dynamic VHD to be smaller than its virtual size: %v %v", fi, err)
+	}
+}
+
+// writeDynamicVhd writes a dynamic VHD of 3 blocks to path, only the second
+// block is allocated. It returns the contents of that block.
+func writeDynamicVhd(t *testing.T, path string) []byte {
+	const blockSize = testBlockSize
+	const size = testDynamicSize
+
+	// footer copy | dynamic header | BAT | bitmap + block 1 | footer
+	var buf bytes.Buffer
+	footer := NewFixedFooter(size)
+	footer.DiskType = DiskTypeDynamic
+	footer.DataOffset = FooterSize
+	footer.Checksum = footer.computeChecksum()
+	buf.Write(footer.Bytes())
+
+	header := make([]byte, dynamicHeaderSize)
+	copy(header, dynamicHeaderCookie)
+	binary.BigEndian.PutUint64(header[8:], fixedDataOffset)
+	binary.BigEndian.PutUint64(header[16:], FooterSize+dynamicHeaderSize)
+	binary.BigEndian.PutUint32(header[24:], 0x00010000)
+	binary.BigEndian.PutUint32(header[28:], 3)
+	binary.BigEndian.PutUint32(header[32:], blockSize)
+	binary.BigEndian.PutUint32(header[36:], checksum(header, dynamicHeaderChecksumPos))
+	buf.Write(header)
+
+	bat := make([]byte, SectorSize)
+	for i := 0; i < 3; i++ {
+		binary.BigEndian.PutUint32(bat[i*4:], unusedBlock)
+	}
+	binary.BigEndian.PutUint32(bat[4:], uint32((FooterSize+dynamicHeaderSize+SectorSize)/SectorSize))
+	buf.Write(bat)
+
+	bitmap := make([]byte, SectorSize)
+	bitmap[0] = 0xC0 // sectors 0 and 1 contain data
+	buf.Write(bitmap)
+	block := bytes.Repeat([]byte{7}, blockSize)
+	buf.Write(block)
+	buf.Write(footer.Bytes())
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// checkFixed checks that path is a valid fixed VHD of size bytes and returns
+// its contents.
+func checkFixed(t *testing.T, path string, size int64) []byte {
+	format, footer, err := Inspect(path)
+	if err != nil || format != FormatFixed {
+		t.Fatalf("expected fixed format, got %v %v", format, err)
+	}
+	if err := footer.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if int64(footer.CurrentSize) != size {
+		t.Fatalf("virtual size is %d, expected %d", footer.CurrentSize, size)
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "vhd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -4,8 +4,10 @@
 package azure
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 )
 
 // This is the common builder ID to all of these artifacts.
@@ -13,14 +15,36 @@ const BuilderId = "Azure.ServiceManagement.VMImage"
 
 // Artifact is the result of running the azure builder.
 type artifact struct {
-	imageLabel    string
-	imageName     string
-	mediaLocation string
+	imageLabel     string
+	imageName      string
+	mediaLocation  string
+	dataDisks      []string
+	location       string
+	storageAccount string
+	instanceSize   string
+	osType         string
+
+	sourceImageName          string
+	sourceImagePublishedDate string
+	buildStartTime           time.Time
+	buildEndTime             time.Time
 
 	publishSettingsPath string
 	subscriptionID      string
 }
 
+// artifactJSON is the representation of the artifact returned by String.
+type artifactJSON struct {
+	ImageLabel      string   `json:"imageLabel"`
+	ImageName       string   `json:"imageName"`
+	MediaLocation   string   `json:"mediaLocation"`
+	DataDisks       []string `json:"dataDisks"`
+	Location        string   `json:"location"`
+	StorageAccount  string   `json:"storageAccount"`
+	SourceImageName string   `json:"sourceImageName"`
+	OSType          string   `json:"osType"`
+}
+
 func (*artifact) BuilderId() string {
 	return BuilderId
 }
@@ -41,17 +65,50 @@ func (a *artifact) State(name string) interface{} {
 		return a.publishSettingsPath
 	case "subscriptionID":
 		return a.subscriptionID
+	case "imageName":
+		return a.imageName
+	case "imageLabel":
+		return a.imageLabel
+	case "osDisk":
+		return a.mediaLocation
+	case "dataDisks":
+		return a.dataDisks
+	case "location":
+		return a.location
+	case "storageAccount":
+		return a.storageAccount
+	case "instanceSize":
+		return a.instanceSize
+	case "osType":
+		return a.osType
+	case "sourceImageName":
+		return a.sourceImageName
+	case "sourceImagePublishedDate":
+		return a.sourceImagePublishedDate
+	case "buildStartTime":
+		return a.buildStartTime.Format(time.RFC3339)
+	case "buildEndTime":
+		return a.buildEndTime.Format(time.RFC3339)
 	default:
 		return nil
 	}
 }
 
 func (a *artifact) String() string {
-	return fmt.Sprintf("{%s,%s,%s}",
-		fmt.Sprintf("\"imageLabel\": \"%s\"", a.imageLabel),
-		fmt.Sprintf("\"imageName\": \"%s\"", a.imageName),
-		fmt.Sprintf("\"mediaLocation\": \"%s\"", a.mediaLocation),
-	)
+	d, err := json.Marshal(artifactJSON{
+		ImageLabel:      a.imageLabel,
+		ImageName:       a.imageName,
+		MediaLocation:   a.mediaLocation,
+		DataDisks:       a.dataDisks,
+		Location:        a.location,
+		StorageAccount:  a.storageAccount,
+		SourceImageName: a.sourceImageName,
+		OSType:          a.osType,
+	})
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return string(d)
 }
 
 func (a *artifact) Destroy() error {
@@ -0,0 +1,98 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common"
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/management/storageservice"
+	vmimage "github.com/Azure/azure-sdk-for-go/management/virtualmachineimage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+const artifactStateError = "Error: Could not retrieve %s for this artifact. Make sure you used the same version of the builder as the post-processor."
+
+// ClientFromArtifact creates a Service Management client using the
+// credentials stored in the state of an artifact.
+func ClientFromArtifact(artifact packer.Artifact) (management.Client, error) {
+	return ClientFromArtifactWithAPIVersion(artifact, management.DefaultAPIVersion)
+}
+
+// ClientFromArtifactWithAPIVersion is like ClientFromArtifact, for operations
+// that need a newer API version than the SDK default.
+func ClientFromArtifactWithAPIVersion(artifact packer.Artifact, apiVersion string) (management.Client, error) {
+	publishSettingsPath, ok := artifact.State("publishSettingsPath").(string)
+	if !ok || publishSettingsPath == "" {
+		return nil, fmt.Errorf(artifactStateError, "publishSettingsPath")
+	}
+	subscriptionID, ok := artifact.State("subscriptionID").(string)
+	if !ok || subscriptionID == "" {
+		return nil, fmt.Errorf(artifactStateError, "subscriptionID")
+	}
+
+	clientConfig := management.DefaultConfig()
+	clientConfig.APIVersion = apiVersion
+	client, err := management.ClientFromPublishSettingsFileWithConfig(publishSettingsPath, subscriptionID, clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating new Azure client: %v", err)
+	}
+	return GetLoggedClient(client), nil
+}
+
+// FindUserVmImage looks up the user VM image with the given name.
+func FindUserVmImage(client management.Client, name string) (vmimage.VMImage, error) {
+	var image vmimage.VMImage
+	if err := retry.ExecuteOperation(func() error {
+		imageList, err := vmimage.NewClient(client).ListVirtualMachineImages(
+			vmimage.ListParameters{
+				Category: vmimage.CategoryUser,
+			})
+		if err != nil {
+			return err
+		}
+
+		for _, i := range imageList.VMImages {
+			if i.Name == name {
+				image = i
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("VM image client returned error: %s", err)
+		return image, err
+	}
+	if image.Name != name {
+		return image, fmt.Errorf("Could not find image: %s", name)
+	}
+	return image, nil
+}
+
+// StorageAccountKey retrieves the primary key of a storage account through
+// the Service Management API.
+func StorageAccountKey(client management.Client, storageAccount string) (string, error) {
+	keys, err := storageservice.NewClient(client).GetStorageServiceKeys(storageAccount)
+	if err != nil {
+		return "", fmt.Errorf("Could not retrieve key for storage account %q: %v", storageAccount, err)
+	}
+	return keys.PrimaryKey, nil
+}
+
+// StorageClientForBlob creates a storage client for the account holding the
+// blob, using the account key retrieved through the Service Management API.
+func StorageClientForBlob(client management.Client, blob common.BlobURL) (storage.Client, error) {
+	key, err := StorageAccountKey(client, blob.StorageAccount)
+	if err != nil {
+		return storage.Client{}, err
+	}
+
+	return storage.NewClient(blob.StorageAccount, key, blob.EndpointSuffix, storage.DefaultAPIVersion, true)
+}
@@ -4,6 +4,9 @@
 package azure
 
 import (
+	"encoding/json"
+	"time"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -13,15 +16,43 @@ var _ = Suite(&ArtifactSuite{})
 
 func (s *ArtifactSuite) Test_State(c *C) {
 	a := artifact{
+		imageName:           "imageName",
+		location:            "West US",
+		sourceImageName:     "sourceImageName",
+		buildStartTime:      time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC),
 		publishSettingsPath: "publishSettingsPath",
 		subscriptionID:      "subscriptionID",
 	}
 
 	c.Check(a.State("publishSettingsPath").(string), Equals, "publishSettingsPath")
 	c.Check(a.State("subscriptionID").(string), Equals, "subscriptionID")
+	c.Check(a.State("imageName").(string), Equals, "imageName")
+	c.Check(a.State("location").(string), Equals, "West US")
+	c.Check(a.State("sourceImageName").(string), Equals, "sourceImageName")
+	c.Check(a.State("buildStartTime").(string), Equals, "2016-10-01T12:00:00Z")
+	c.Check(a.State("dataDisks"), IsNil)
+	c.Check(a.State("unknown"), IsNil)
 }
 
 func (s *ArtifactSuite) Test_BuilderId(c *C) {
 	a := artifact{}
 	c.Check(a.BuilderId(), Equals, "Azure.ServiceManagement.VMImage")
 }
+
+func (s *ArtifactSuite) Test_String(c *C) {
+	a := artifact{
+		imageLabel:    `label "with" quotes`,
+		imageName:     "imageName",
+		mediaLocation: "https://sa.blob.core.windows.net/vhds/os.vhd",
+		dataDisks:     []string{"https://sa.blob.core.windows.net/vhds/data.vhd"},
+		osType:        "Linux",
+	}
+
+	var decoded map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(a.String()), &decoded), IsNil)
+	c.Check(decoded["imageLabel"], Equals, `label "with" quotes`)
+	c.Check(decoded["imageName"], Equals, "imageName")
+	c.Check(decoded["mediaLocation"], Equals, "https://sa.blob.core.windows.net/vhds/os.vhd")
+	c.Check(decoded["dataDisks"], DeepEquals, []interface{}{"https://sa.blob.core.windows.net/vhds/data.vhd"})
+	c.Check(decoded["osType"], Equals, "Linux")
+}
@@ -0,0 +1,194 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+)
+
+// Names of the extended properties that identify the build, the tags of the
+// user are added with their own names.
+const (
+	propertyBuildName    = "PackerBuildName"
+	propertyTemplateHash = "PackerTemplateHash"
+	propertyHost         = "PackerHost"
+	propertyTimestamp    = "PackerTimestamp"
+)
+
+// Limits of hosted service extended properties and descriptions.
+const (
+	maxTags                  = 50 - 4 // 50 extended properties, 4 of the build
+	maxExtendedPropertyValue = 255
+	maxHostedServiceDescLen  = 1024
+)
+
+var extendedPropertyNameRegex = regexp.MustCompile("^[A-Za-z][A-Za-z0-9_]{0,63}$")
+
+// buildMetadata identifies the build that created a resource.
+type buildMetadata struct {
+	BuildName    string
+	TemplateHash string
+	Host         string
+	Timestamp    time.Time
+	Tags         map[string]string
+}
+
+func newBuildMetadata(c *Config, raws []interface{}) buildMetadata {
+	host, _ := os.Hostname()
+	return buildMetadata{
+		BuildName:    c.PackerBuildName,
+		TemplateHash: templateHash(raws),
+		Host:         host,
+		Timestamp:    time.Now().UTC(),
+		Tags:         c.Tags,
+	}
+}
+
+// templateHash returns the SHA-256 of the template file that packer passes
+// as packer_template_path. Without a readable template it falls back to the
+// hash of the builder configuration, without the values that packer adds for
+// every build.
+func templateHash(raws []interface{}) string {
+	merged := make(map[string]interface{})
+	templatePath := ""
+	for _, raw := range raws {
+		if m, ok := raw.(map[string]interface{}); ok {
+			for k, v := range m {
+				if k == "packer_template_path" {
+					templatePath, _ = v.(string)
+				}
+				if !strings.HasPrefix(k, "packer_") {
+					merged[k] = v
+				}
+			}
+		}
+	}
+
+	if templatePath != "" {
+		if data, err := ioutil.ReadFile(templatePath); err == nil {
+			return fmt.Sprintf("%x", sha256.Sum256(data))
+		}
+		log.Printf("Could not read the template %s, hashing the builder configuration instead", templatePath)
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// validateTags checks the user tags against the rules of hosted service
+// extended properties.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags can be specified", maxTags)
+	}
+	for name, value := range tags {
+		if !extendedPropertyNameRegex.MatchString(name) {
+			return fmt.Errorf("tag name %q is not valid, it should follow the pattern %s", name, extendedPropertyNameRegex)
+		}
+		if strings.HasPrefix(name, "Packer") {
+			return fmt.Errorf("tag name %q is reserved, names cannot start with Packer", name)
+		}
+		if len(value) > maxExtendedPropertyValue {
+			return fmt.Errorf("value of tag %q is longer than %d characters", name, maxExtendedPropertyValue)
+		}
+	}
+	return nil
+}
+
+// properties returns the metadata as extended properties, in a stable
+// order.
+func (m buildMetadata) properties() []extendedProperty {
+	properties := []extendedProperty{
+		{propertyBuildName, m.BuildName},
+		{propertyTemplateHash, m.TemplateHash},
+		{propertyHost, m.Host},
+		{propertyTimestamp, m.Timestamp.Format(time.RFC3339)},
+	}
+
+	var names []string
+	for name := range m.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		properties = append(properties, extendedProperty{name, m.Tags[name]})
+	}
+	return properties
+}
+
+// description returns the metadata as one line, e.g. for image
+// descriptions.
+func (m buildMetadata) description() string {
+	var parts []string
+	for _, p := range m.properties() {
+		if p.Value != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", p.Name, p.Value))
+		}
+	}
+
+	description := "Created by packer: " + strings.Join(parts, ", ")
+	if len(description) > maxHostedServiceDescLen {
+		description = description[:maxHostedServiceDescLen]
+	}
+	return description
+}
+
+type extendedProperty struct {
+	Name  string
+	Value string
+}
+
+// createHostedServiceRequest is hostedservice.CreateHostedServiceParameters
+// with the extended properties that the SDK does not send.
+type createHostedServiceRequest struct {
+	XMLName            xml.Name `xml:"http://schemas.microsoft.com/windowsazure CreateHostedService"`
+	ServiceName        string
+	Label              string
+	Description        string
+	Location           string             `xml:",omitempty"`
+	AffinityGroup      string             `xml:",omitempty"`
+	ExtendedProperties []extendedProperty `xml:"ExtendedProperties>ExtendedProperty,omitempty"`
+}
+
+// createHostedService creates a hosted service that is described and tagged
+// with the build metadata. The service is created in the affinity group if
+// it is set, in the location otherwise.
+func createHostedService(client management.Client, serviceName, location, affinityGroup string, metadata buildMetadata) error {
+	request := createHostedServiceRequest{
+		ServiceName:        serviceName,
+		Label:              base64.StdEncoding.EncodeToString([]byte(serviceName)),
+		Description:        metadata.description(),
+		Location:           location,
+		AffinityGroup:      affinityGroup,
+		ExtendedProperties: metadata.properties(),
+	}
+	if affinityGroup != "" {
+		request.Location = ""
+	}
+
+	data, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	// not a long running operation, as in hostedservice.CreateHostedService
+	_, err = client.SendAzurePostRequest("services/hostedservices", data)
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+)
+
+// postClient records POST requests, all other calls panic.
+type postClient struct {
+	management.Client
+	url  string
+	data []byte
+}
+
+func (c *postClient) SendAzurePostRequest(url string, data []byte) (management.OperationID, error) {
+	c.url = url
+	c.data = data
+	return "", nil
+}
+
+func testBuildMetadata() buildMetadata {
+	return buildMetadata{
+		BuildName:    "ubuntu",
+		TemplateHash: "abc123",
+		Host:         "ci-agent-1",
+		Timestamp:    time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Tags:         map[string]string{"team": "infra", "pipeline": "nightly"},
+	}
+}
+
+func TestCreateHostedService(t *testing.T) {
+	client := new(postClient)
+	if err := createHostedService(client, "PkrSrvtest", "West US", "", testBuildMetadata()); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.url != "services/hostedservices" {
+		t.Fatalf("unexpected URL %q", client.url)
+	}
+	request := string(client.data)
+	for _, expected := range []string{
+		"<ServiceName>PkrSrvtest</ServiceName><Label>UGtyU3J2dGVzdA==</Label>",
+		"<Description>Created by packer: PackerBuildName=ubuntu, PackerTemplateHash=abc123, PackerHost=ci-agent-1, PackerTimestamp=2016-01-02T03:04:05Z, pipeline=nightly, team=infra</Description>",
+		"<Location>West US</Location><ExtendedProperties><ExtendedProperty><Name>PackerBuildName</Name><Value>ubuntu</Value></ExtendedProperty>",
+		"<ExtendedProperty><Name>team</Name><Value>infra</Value></ExtendedProperty></ExtendedProperties>",
+	} {
+		if !strings.Contains(request, expected) {
+			t.Errorf("expected %s in request %s", expected, request)
+		}
+	}
+}
+
+func TestCreateHostedService_AffinityGroup(t *testing.T) {
+	client := new(postClient)
+	if err := createHostedService(client, "PkrSrvtest", "West US", "build-group", testBuildMetadata()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := string(client.data)
+	if strings.Contains(request, "<Location>") || !strings.Contains(request, "</Description><AffinityGroup>build-group</AffinityGroup><ExtendedProperties>") {
+		t.Fatalf("expected affinity group instead of location in request %s", request)
+	}
+}
+
+func TestTemplateHash(t *testing.T) {
+	a := templateHash([]interface{}{map[string]interface{}{"location": "West US", "packer_build_name": "a"}})
+	b := templateHash([]interface{}{map[string]interface{}{"location": "West US", "packer_build_name": "b"}})
+	c := templateHash([]interface{}{map[string]interface{}{"location": "East US"}})
+
+	if len(a) != 64 || a != b || a == c {
+		t.Fatalf("unexpected hashes %q %q %q", a, b, c)
+	}
+}
+
+func TestTemplateHash_TemplatePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer-azure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	template := `{"builders":[{"type":"azure"}]}`
+	path := filepath.Join(dir, "template.json")
+	if err := ioutil.WriteFile(path, []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := templateHash([]interface{}{map[string]interface{}{"location": "West US", "packer_template_path": path}})
+	b := templateHash([]interface{}{map[string]interface{}{"location": "East US", "packer_template_path": path}})
+	if expected := fmt.Sprintf("%x", sha256.Sum256([]byte(template))); a != expected || b != expected {
+		t.Fatalf("expected the hash %q of the template, got %q %q", expected, a, b)
+	}
+
+	missing := templateHash([]interface{}{map[string]interface{}{"location": "West US", "packer_template_path": filepath.Join(dir, "missing.json")}})
+	if fallback := templateHash([]interface{}{map[string]interface{}{"location": "West US"}}); missing != fallback {
+		t.Fatalf("expected the configuration hash %q for a missing template, got %q", fallback, missing)
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	tcs := []struct {
+		tags map[string]string
+		err  bool
+	}{
+		{map[string]string{"team": "infra", "cost_center": "42"}, false},
+		{map[string]string{"1team": "infra"}, true},
+		{map[string]string{"team-name": "infra"}, true},
+		{map[string]string{"PackerHost": "spoofed"}, true},
+		{map[string]string{"team": strings.Repeat("x", 256)}, true},
+	}
+
+	for _, tc := range tcs {
+		if err := validateTags(tc.tags); (err != nil) != tc.err {
+			t.Errorf("unexpected error value for %v: %v", tc.tags, err)
+		}
+	}
+}
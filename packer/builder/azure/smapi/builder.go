@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/management"
 	vmimage "github.com/Azure/azure-sdk-for-go/management/virtualmachineimage"
@@ -41,6 +42,8 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 // Run executes a Packer build and returns a packer.Artifact representing
 // a Azure VM image.
 func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
+	buildStartTime := time.Now().UTC()
+
 	ui.Say("Preparing builder...")
 
 	ui.Message("Creating Azure Service Management client...")
@@ -56,6 +59,18 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 	// add logger if appropriate
 	b.client = GetLoggedClient(b.client)
 
+	if b.config.AffinityGroup != "" {
+		ui.Message(fmt.Sprintf("Looking up location of affinity group %q...", b.config.AffinityGroup))
+		location, err := getAffinityGroupLocation(b.client, b.config.AffinityGroup)
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up affinity group %q: %v", b.config.AffinityGroup, err)
+		}
+		if b.config.Location != "" && b.config.Location != location {
+			return nil, fmt.Errorf("Affinity group %q is not in location %q, but in %q", b.config.AffinityGroup, b.config.Location, location)
+		}
+		b.config.Location = location
+	}
+
 	// Set up the state.
 	state := new(multistep.BasicStateBag)
 	state.Put(constants.Config, b.config)
@@ -78,10 +93,14 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		steps = []multistep.Step{
 			&lin.StepCreateCert{
 				TmpServiceName: b.config.tmpServiceName,
+				PrivateKeyFile: b.config.Comm.SSHPrivateKey,
+				Debug:          b.config.PackerDebug,
+				DebugKeyPath:   fmt.Sprintf("azure_%s.pem", b.config.PackerBuildName),
 			},
 			new(StepValidate),
 			&StepCreateService{
 				Location:       b.config.Location,
+				AffinityGroup:  b.config.AffinityGroup,
 				TmpServiceName: b.config.tmpServiceName,
 			},
 			&StepUploadCertificate{
@@ -97,12 +116,14 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 			&communicator.StepConnectSSH{
 				Config:    &b.config.Comm,
 				Host:      lin.SSHHost,
-				SSHConfig: lin.SSHConfig(b.config.UserName),
+				SSHConfig: lin.SSHConfig(b.config.UserName, b.config.Comm.SSHPassword),
 			},
 			&common.StepProvision{},
 
 			&lin.StepGeneralizeOS{
-				Command: "sudo /usr/sbin/waagent -force -deprovision+user && export HISTSIZE=0 && sync",
+				Command:         b.config.DeprovisionCommand,
+				PreCommands:     b.config.PreDeprovisionCommands,
+				SkipDeprovision: b.config.SkipDeprovision,
 			},
 			&StepStopVm{
 				TmpVmName:      b.config.tmpVmName,
@@ -116,11 +137,26 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 				RecommendedVMSize: b.config.InstanceSize,
 			},
 		}
+
+		if b.config.WaitForCloudInit {
+			// cloud-init has to be done before anything gets provisioned
+			for i, step := range steps {
+				if _, ok := step.(*common.StepProvision); ok {
+					steps = append(steps[:i], append([]multistep.Step{
+						&lin.StepWaitForCloudInit{
+							Timeout: b.config.CloudInitTimeout,
+						},
+					}, steps[i:]...)...)
+					break
+				}
+			}
+		}
 	} else if b.config.OSType == constants.Target_Windows {
 		steps = []multistep.Step{
 			new(StepValidate),
 			&StepCreateService{
 				Location:       b.config.Location,
+				AffinityGroup:  b.config.AffinityGroup,
 				TmpServiceName: b.config.tmpServiceName,
 			},
 			new(StepCreateVm),
@@ -150,15 +186,153 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 			},
 		}
 
+		if b.config.PackerDebug {
+			for i, step := range steps {
+				if _, ok := step.(*StepPollStatus); ok {
+					steps = append(steps[:i+1], append([]multistep.Step{
+						&StepDebugAccess{
+							TmpServiceName: b.config.tmpServiceName,
+							TmpVmName:      b.config.tmpVmName,
+							RdpFilePath:    fmt.Sprintf("azure_%s.rdp", b.config.PackerBuildName),
+						},
+					}, steps[i+1:]...)...)
+					break
+				}
+			}
+		}
+
+		if len(b.config.StoredCertificates) > 0 {
+			for i, step := range steps {
+				if _, ok := step.(*StepCreateService); ok {
+					steps = append(steps[:i+1], append([]multistep.Step{
+						&StepUploadStoredCertificates{
+							TmpServiceName: b.config.tmpServiceName,
+							Certificates:   b.config.StoredCertificates,
+						},
+					}, steps[i+1:]...)...)
+					break
+				}
+			}
+		}
 	} else {
 		return nil, fmt.Errorf("Unkonwn OS type: %s", b.config.OSType)
 	}
 
+	// Diagnostics are saved on failure before the temporary service is
+	// removed, while the VM still exists.
+	for i, step := range steps {
+		if _, ok := step.(*StepCreateVm); ok {
+			steps = append(steps[:i+1], append([]multistep.Step{
+				&StepSaveDiagnostics{
+					TmpServiceName: b.config.tmpServiceName,
+					TmpVmName:      b.config.tmpVmName,
+					Path:           fmt.Sprintf("%s-diagnostics.json", b.config.tmpVmName),
+				},
+			}, steps[i+1:]...)...)
+			break
+		}
+	}
+
+	// The disks are removed after the temporary service.
+	for i, step := range steps {
+		if _, ok := step.(*StepCreateService); ok {
+			steps = append(steps[:i], append([]multistep.Step{
+				&StepCleanupDisks{
+					TmpServiceName: b.config.tmpServiceName,
+				},
+			}, steps[i:]...)...)
+			break
+		}
+	}
+
+	if b.config.SourceVhdPath != "" {
+		// The source VHD is uploaded after the storage account was
+		// validated and before the VM is created.
+		for i, step := range steps {
+			if _, ok := step.(*StepValidate); ok {
+				steps = append(steps[:i+1], append([]multistep.Step{
+					&StepUploadSourceVhd{
+						SourceVhdPath: b.config.SourceVhdPath,
+						OSImageName:   b.config.tmpOSImageName,
+						OSType:        b.config.OSType,
+					},
+				}, steps[i+1:]...)...)
+				break
+			}
+		}
+	}
+
+	if b.config.SmokeTest {
+		steps = append(steps, &StepSmokeTest{
+			ServiceName:          b.config.tmpSmokeTestServiceName,
+			VmName:               b.config.tmpSmokeTestVmName,
+			ContainerName:        b.config.tmpSmokeTestContainerName,
+			UserImageName:        b.config.userImageName,
+			Commands:             b.config.SmokeTestCommands,
+			RemoveImageOnFailure: b.config.RemoveImageOnSmokeTestFailure,
+		})
+	}
+
+	if b.config.createStorageAccount {
+		steps = append([]multistep.Step{
+			&StepCreateStorageAccount{
+				StorageAccount:  b.config.StorageAccount,
+				Location:        b.config.Location,
+				AffinityGroup:   b.config.AffinityGroup,
+				RemoveOnFailure: b.config.RemoveCreatedAccountOnFailure,
+			},
+		}, steps...)
+	}
+
+	// Every step records its progress and the resources it creates in the
+	// journal.
+	journal := newJournal(b.config.JournalPath, b.config)
+	resume := b.config.resumeJournal != nil
+	if resume {
+		journal = b.config.resumeJournal
+		ui.Say(fmt.Sprintf("Resuming the build of journal %s...", journal.Path()))
+	}
+
+	vmStopped := journal.completed(stepName(new(StepStopVm)))
+	rerun := make(map[string]bool)
+	for i, step := range steps {
+		s := &journaledStep{
+			Step:        step,
+			journal:     journal,
+			name:        stepName(step),
+			resume:      resume,
+			keepOnError: b.config.OnError == onErrorKeep,
+		}
+		switch step.(type) {
+		case *StepSaveDiagnostics:
+			s.rerun = true
+			s.keepOnError = false
+		case *StepValidate:
+			// sets up the configuration of the VM
+			s.rerun = true
+		case *StepPollStatus, *communicator.StepConnectSSH, *StepSetProvisionInfrastructure, *StepDebugAccess:
+			// reconnect to the VM if it is still running
+			s.rerun = !vmStopped
+		}
+		rerun[s.name] = s.rerun
+		steps[i] = s
+	}
+
+	if resume {
+		journal.restoreState(state)
+		if err := journal.discardUnfinished(b.client, ui, rerun); err != nil {
+			return nil, err
+		}
+	} else if err := journal.Save(); err != nil {
+		return nil, fmt.Errorf("Error writing journal: %v", err)
+	}
+	state.Put(constants.Journal, journal)
+
 	// Run the steps.
 	if b.config.PackerDebug {
 		b.runner = &multistep.DebugRunner{
 			Steps:   steps,
-			PauseFn: common.MultistepDebugFn(ui),
+			PauseFn: journalPauseFn(journal, common.MultistepDebugFn(ui)),
 		}
 	} else {
 		b.runner = &multistep.BasicRunner{Steps: steps}
@@ -167,9 +341,21 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 
 	// Report any errors.
 	if rawErr, ok := state.GetOk("error"); ok {
+		if b.config.OnError == onErrorKeep {
+			ui.Say(fmt.Sprintf("Kept the temporary resources listed in %s, resume the build with resume_from_journal or remove them with packer-azure-cleanup", journal.Path()))
+		} else if len(journal.Resources) > 0 {
+			ui.Error(fmt.Sprintf("Could not remove all temporary resources, remove those listed in %s with packer-azure-cleanup", journal.Path()))
+		} else if err := journal.Remove(); err != nil {
+			// the steps were cleaned up, the journal cannot be resumed
+			ui.Error(fmt.Sprintf("Error removing journal: %s", err))
+		}
 		return nil, rawErr.(error)
 	}
 
+	if err := journal.Remove(); err != nil {
+		ui.Error(fmt.Sprintf("Error removing journal: %s", err))
+	}
+
 	// If we were interrupted or cancelled, then just exit.
 	if _, ok := state.GetOk(multistep.StateCancelled); ok {
 		return nil, errors.New("Build was cancelled.")
@@ -189,10 +375,25 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 	}
 
 	if userImage, found := FindVmImage(vmImageList.VMImages, b.config.userImageName, b.config.UserImageLabel); found {
+		dataDisks := make([]string, len(userImage.DataDiskConfigurations))
+		for i, d := range userImage.DataDiskConfigurations {
+			dataDisks[i] = d.MediaLink
+		}
+
 		return &artifact{
-			imageLabel:    userImage.Label,
-			imageName:     userImage.Name,
-			mediaLocation: userImage.OSDiskConfiguration.MediaLink,
+			imageLabel:     userImage.Label,
+			imageName:      userImage.Name,
+			mediaLocation:  userImage.OSDiskConfiguration.MediaLink,
+			dataDisks:      dataDisks,
+			location:       b.config.Location,
+			storageAccount: b.config.StorageAccount,
+			instanceSize:   b.config.InstanceSize,
+			osType:         b.config.OSType,
+
+			sourceImageName:          b.config.sourceImageName,
+			sourceImagePublishedDate: b.config.sourceImagePublishedDate,
+			buildStartTime:           buildStartTime,
+			buildEndTime:             time.Now().UTC(),
 
 			publishSettingsPath: b.config.PublishSettingsPath,
 			subscriptionID:      subscriptionID,
@@ -1,15 +1,19 @@
 package azure
 
 import (
+	"encoding/base64"
 	"fmt"
+	vmdisk "github.com/Azure/azure-sdk-for-go/management/virtualmachinedisk"
 	"github.com/Azure/azure-sdk-for-go/storage"
 	azureCommon "github.com/Azure/packer-azure/packer/builder/azure/common"
 	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/vhd"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/communicator"
 	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -17,38 +21,93 @@ import (
 	"time"
 )
 
+// storageAccountAuto can be specified as storage_account to let the builder
+// create a new storage account in the build location.
+const storageAccountAuto = "auto"
+
+// maxCustomDataSize is the maximum size of the decoded custom data accepted
+// by the service management API.
+const maxCustomDataSize = 65535
+
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 
 	SubscriptionName    string `mapstructure:"subscription_name"`
 	PublishSettingsPath string `mapstructure:"publish_settings_path"`
 
-	StorageAccount    string `mapstructure:"storage_account"`
-	storageAccountKey string
-	storageClient     storage.Client
-	StorageContainer  string        `mapstructure:"storage_account_container"`
-	Location          string        `mapstructure:"location"`
-	InstanceSize      string        `mapstructure:"instance_size"`
-	DataDisks         []interface{} `mapstructure:"data_disks"`
-	UserImageLabel    string        `mapstructure:"user_image_label"`
+	StorageAccount                  string `mapstructure:"storage_account"`
+	RemoveCreatedAccountOnFailure   bool   `mapstructure:"remove_created_storage_account_on_failure"`
+	createStorageAccount            bool
+	storageAccountKey               string
+	storageAccountType              string
+	storageClient                   storage.Client
+	StorageContainer                string `mapstructure:"storage_account_container"`
+	RemoveCreatedContainerOnFailure bool   `mapstructure:"remove_created_container_on_failure"`
+	storageContainerCreated         bool
+	Location                        string        `mapstructure:"location"`
+	AffinityGroup                   string        `mapstructure:"affinity_group"`
+	InstanceSize                    string        `mapstructure:"instance_size"`
+	DataDisks                       []interface{} `mapstructure:"data_disks"`
+	OSDiskCaching                   string        `mapstructure:"os_disk_caching"`
+	DataDiskCaching                 string        `mapstructure:"data_disk_caching"`
+	UserImageLabel                  string        `mapstructure:"user_image_label"`
 
 	OSType                string `mapstructure:"os_type"`
 	OSImageLabel          string `mapstructure:"os_image_label"`
 	OSImageName           string `mapstructure:"os_image_name"`
 	RemoteSourceImageLink string `mapstructure:"remote_source_image_link"`
+	SourceVhdPath         string `mapstructure:"source_vhd_path"`
 	ResizeOSVhdGB         *int   `mapstructure:"resize_os_vhd_gb"`
 
+	sourceImageName          string
+	sourceImagePublishedDate string
+
 	ProvisionTimeoutInMinutes uint `mapstructure:"provision_timeout_in_minutes"`
 
-	VNet   string `mapstructure:"vnet"`
-	Subnet string `mapstructure:"subnet"`
+	VNet           string `mapstructure:"vnet"`
+	Subnet         string `mapstructure:"subnet"`
+	ReservedIPName string `mapstructure:"reserved_ip_name"`
+
+	CustomData       string        `mapstructure:"custom_data"`
+	CustomDataFile   string        `mapstructure:"custom_data_file"`
+	WaitForCloudInit bool          `mapstructure:"wait_for_cloud_init"`
+	CloudInitTimeout time.Duration `mapstructure:"cloud_init_timeout"`
+	customData       string
+
+	TimeZone                  string              `mapstructure:"time_zone"`
+	EnableAutomaticUpdates    *bool               `mapstructure:"enable_automatic_updates"`
+	AdditionalUnattendContent []UnattendContent   `mapstructure:"additional_unattend_content"`
+	StoredCertificates        []StoredCertificate `mapstructure:"stored_certificates"`
+	additionalUnattendContent string
+
+	DeprovisionCommand     string   `mapstructure:"deprovision_command"`
+	SkipDeprovision        bool     `mapstructure:"skip_deprovision"`
+	PreDeprovisionCommands []string `mapstructure:"pre_deprovision_commands"`
+
+	SmokeTest                     bool     `mapstructure:"smoke_test"`
+	SmokeTestCommands             []string `mapstructure:"smoke_test_commands"`
+	RemoveImageOnSmokeTestFailure bool     `mapstructure:"remove_image_on_smoke_test_failure"`
+
+	Tags     map[string]string `mapstructure:"tags"`
+	metadata buildMetadata
+
+	JournalPath       string `mapstructure:"journal_path"`
+	OnError           string `mapstructure:"on_error"`
+	ResumeFromJournal string `mapstructure:"resume_from_journal"`
+	resumeJournal     *Journal
 
 	UserName         string `mapstructure:"username"`
 	tmpVmName        string
 	tmpServiceName   string
 	tmpContainerName string
+	tmpOSImageName   string
+	tmpAdminPassword string
 	userImageName    string
 
+	tmpSmokeTestServiceName   string
+	tmpSmokeTestVmName        string
+	tmpSmokeTestContainerName string
+
 	Comm communicator.Config `mapstructure:",squash"`
 
 	ctx *interpolate.Context
@@ -85,13 +144,66 @@ func newConfig(raws ...interface{}) (*Config, []string, error) {
 		c.Comm.SSHTimeout = 20 * time.Minute
 	}
 
+	if c.OSDiskCaching == "" {
+		c.OSDiskCaching = string(vmdisk.HostCachingTypeReadWrite)
+	}
+	if c.DataDiskCaching == "" {
+		c.DataDiskCaching = string(vmdisk.HostCachingTypeNone)
+	}
+
+	if c.CloudInitTimeout == 0 {
+		c.CloudInitTimeout = 20 * time.Minute
+	}
+
 	randSuffix := azureCommon.RandomString("0123456789abcdefghijklmnopqrstuvwxyz", 10)
 	c.tmpVmName = "PkrVM" + randSuffix
 	c.tmpServiceName = "PkrSrv" + randSuffix
 	c.tmpContainerName = "packer-provision-" + randSuffix
+	c.tmpOSImageName = "PkrImg" + randSuffix
 
 	// Check values
 	var errs *packer.MultiError
+
+	if c.ResumeFromJournal != "" {
+		// the resumed build reuses the temporary resources of the journal
+		if c.resumeJournal, err = ReadJournal(c.ResumeFromJournal); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("resume_from_journal could not be read: %s", err))
+		} else {
+			c.tmpVmName = c.resumeJournal.VmName
+			c.tmpServiceName = c.resumeJournal.ServiceName
+			c.tmpContainerName = c.resumeJournal.ContainerName
+			c.tmpOSImageName = c.resumeJournal.OSImageName
+		}
+		if c.JournalPath != "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("journal_path cannot be used with resume_from_journal"))
+		}
+		c.JournalPath = c.ResumeFromJournal
+	}
+
+	c.tmpSmokeTestServiceName = c.tmpServiceName + "st"
+	c.tmpSmokeTestVmName = c.tmpVmName + "st"
+	c.tmpSmokeTestContainerName = c.tmpContainerName + "-st"
+
+	if c.StorageAccount == storageAccountAuto {
+		c.StorageAccount = "pkrsa" + randSuffix
+		if c.resumeJournal != nil {
+			c.StorageAccount = c.resumeJournal.StorageAccount
+		}
+		c.createStorageAccount = true
+		log.Println(fmt.Sprintf("Using dynamically generated storage_account [%s]", c.StorageAccount))
+	}
+
+	if c.JournalPath == "" {
+		c.JournalPath = fmt.Sprintf("%s-journal.json", c.tmpVmName)
+	}
+
+	switch c.OnError {
+	case "":
+		c.OnError = onErrorCleanup
+	case onErrorCleanup, onErrorKeep:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("on_error must be %s or %s", onErrorCleanup, onErrorKeep))
+	}
 	errs = packer.MultiErrorAppend(errs, c.Comm.Prepare(c.ctx)...)
 
 	if c.SubscriptionName == "" {
@@ -126,13 +238,28 @@ func newConfig(raws ...interface{}) (*Config, []string, error) {
 	if c.OSImageName != "" {
 		count += 1
 	}
+	if c.SourceVhdPath != "" {
+		count += 1
+	}
 
 	if count != 1 {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("One source and only one among os_image_label, os_image_label or remote_source_image_link has to be specified"))
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("One source and only one among os_image_label, os_image_label, remote_source_image_link or source_vhd_path has to be specified"))
+	}
+
+	if c.SourceVhdPath != "" {
+		if fi, err := os.Stat(c.SourceVhdPath); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_vhd_path is not a valid path: %s", err))
+		} else if fi.Size() == 0 {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_vhd_path %s is empty", c.SourceVhdPath))
+		} else if format, _, err := vhd.Inspect(c.SourceVhdPath); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_vhd_path is not a valid VHD: %s", err))
+		} else if format == vhd.FormatDifferencing {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_vhd_path is a differencing VHD, merge it with its parent first"))
+		}
 	}
 
-	if c.Location == "" {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("location must be specified"))
+	if c.Location == "" && c.AffinityGroup == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("location or affinity_group must be specified"))
 	}
 
 	if c.InstanceSize == "" {
@@ -153,6 +280,10 @@ func newConfig(raws ...interface{}) (*Config, []string, error) {
 		}
 	}
 
+	if err := validateDiskCaching(c.OSDiskCaching, c.DataDiskCaching); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
 	if c.UserImageLabel == "" {
 		log.Println(fmt.Sprintf("Using dynamically generated user_image_label [%s]", c.tmpVmName))
 		c.UserImageLabel = c.tmpVmName
@@ -164,12 +295,120 @@ func newConfig(raws ...interface{}) (*Config, []string, error) {
 	}
 
 	c.userImageName = fmt.Sprintf("%s_%s", c.UserImageLabel, time.Now().Format("2006-01-02_15-04"))
+	if c.resumeJournal != nil {
+		c.userImageName = c.resumeJournal.UserImageName
+	}
+
+	if c.CustomData != "" || c.CustomDataFile != "" || c.WaitForCloudInit {
+		if c.OSType != constants.Target_Linux {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("custom_data, custom_data_file and wait_for_cloud_init are only supported for os_type %s", constants.Target_Linux))
+		}
+	}
+
+	if c.CustomData != "" && c.CustomDataFile != "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Only one of custom_data or custom_data_file can be specified"))
+	}
+
+	customData := []byte(c.CustomData)
+	if c.CustomDataFile != "" {
+		if customData, err = ioutil.ReadFile(c.CustomDataFile); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("custom_data_file could not be read: %s", err))
+		}
+	}
+	if len(customData) > maxCustomDataSize {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("custom data is %d bytes, it cannot exceed %d bytes", len(customData), maxCustomDataSize))
+	}
+	if len(customData) > 0 {
+		c.customData = base64.StdEncoding.EncodeToString(customData)
+	}
+
+	if c.OSType == constants.Target_Windows {
+		c.tmpAdminPassword = azureCommon.RandomPassword()
+		if c.resumeJournal != nil {
+			c.tmpAdminPassword = c.resumeJournal.AdminPassword
+		}
+		if err := validateWindowsUserName(c.UserName); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+		if err := validateWindowsPassword(c.tmpAdminPassword); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("generated admin %s", err))
+		}
+	}
+
+	if c.DeprovisionCommand != "" || c.SkipDeprovision || len(c.PreDeprovisionCommands) > 0 {
+		if c.OSType != constants.Target_Linux {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("deprovision_command, skip_deprovision and pre_deprovision_commands are only supported for os_type %s", constants.Target_Linux))
+		}
+	}
+
+	if c.DeprovisionCommand != "" && c.SkipDeprovision {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("deprovision_command cannot be used with skip_deprovision"))
+	}
+
+	if c.Comm.SSHPassword != "" || c.Comm.SSHPrivateKey != "" {
+		if c.OSType != constants.Target_Linux {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("ssh_password and ssh_private_key_file are only supported for os_type %s", constants.Target_Linux))
+		}
+	}
+
+	if c.Comm.SSHPassword != "" && (len(c.Comm.SSHPassword) < 6 || len(c.Comm.SSHPassword) > 72) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("ssh_password must be 6 to 72 characters long"))
+	}
+
+	if c.TimeZone != "" || c.EnableAutomaticUpdates != nil || len(c.AdditionalUnattendContent) > 0 || len(c.StoredCertificates) > 0 {
+		if c.OSType != constants.Target_Windows {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("time_zone, enable_automatic_updates, additional_unattend_content and stored_certificates are only supported for os_type %s", constants.Target_Windows))
+		}
+	}
+
+	if c.EnableAutomaticUpdates == nil {
+		enableAutomaticUpdates := true
+		c.EnableAutomaticUpdates = &enableAutomaticUpdates
+	}
+
+	for n := range c.AdditionalUnattendContent {
+		if err := c.AdditionalUnattendContent[n].prepare(); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("additional_unattend_content # %d: %s", n, err))
+		}
+	}
+	if len(c.AdditionalUnattendContent) > 0 {
+		if c.additionalUnattendContent, err = marshalUnattendContent(c.AdditionalUnattendContent); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("additional_unattend_content: %s", err))
+		}
+	}
+
+	for n := range c.StoredCertificates {
+		if err := c.StoredCertificates[n].prepare(); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("stored_certificates # %d: %s", n, err))
+		}
+	}
+
+	if !c.SmokeTest && (len(c.SmokeTestCommands) > 0 || c.RemoveImageOnSmokeTestFailure) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("smoke_test_commands and remove_image_on_smoke_test_failure require smoke_test"))
+	}
+
+	if c.resumeJournal != nil {
+		if !c.resumeJournal.resumable() {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("resume_from_journal is a journal of a build without on_error=%s, its resources were removed", onErrorKeep))
+		}
+		if c.resumeJournal.SubscriptionName != c.SubscriptionName || c.resumeJournal.OSType != c.OSType {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("resume_from_journal is a journal of another subscription or os_type"))
+		}
+		if c.resumeJournal.StorageAccount != c.StorageAccount {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("resume_from_journal is a journal of storage account %q", c.resumeJournal.StorageAccount))
+		}
+	}
+
+	if err := validateTags(c.Tags); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+	c.metadata = newBuildMetadata(&c, raws)
 
 	if (c.VNet != "" && c.Subnet == "") || (c.Subnet != "" && c.VNet == "") {
 		errs = packer.MultiErrorAppend(errs, fmt.Errorf("vnet and subnet need to either both be set or both be empty"))
 	}
 
-	log.Println(common.ScrubConfig(c))
+	log.Println(common.ScrubConfig(c, c.Comm.SSHPassword, c.tmpAdminPassword))
 
 	if errs != nil && len(errs.Errors) > 0 {
 		return nil, nil, errs
@@ -2,11 +2,13 @@ package azure
 
 import (
 	"encoding/json"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/vhd"
 	"github.com/mitchellh/mapstructure"
 	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -64,6 +66,265 @@ func TestConfig_VNet(t *testing.T) {
 	}
 }
 
+func TestConfig_CustomData(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	cfgmap := getDefaultTestConfig(f)
+	cfgmap["custom_data"] = "#cloud-config\n"
+	cfg, _, err := newConfig(cfgmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "I2Nsb3VkLWNvbmZpZwo="; cfg.customData != expected {
+		t.Errorf("expected custom data %q, got %q", expected, cfg.customData)
+	}
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["custom_data_file"] = f }, false},
+		{func(cfg map[string]interface{}) { cfg["wait_for_cloud_init"] = true }, false},
+		{func(cfg map[string]interface{}) { cfg["custom_data_file"] = f + ".missing" }, true},
+		{func(cfg map[string]interface{}) { cfg["custom_data"] = "x"; cfg["custom_data_file"] = f }, true},
+		{func(cfg map[string]interface{}) { cfg["custom_data"] = strings.Repeat("x", maxCustomDataSize+1) }, true},
+		{func(cfg map[string]interface{}) { cfg["os_type"] = "Windows"; cfg["custom_data"] = "x" }, true},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
+func TestConfig_SSHPassword(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["ssh_password"] = "s3cr3t!" }, false},
+		{func(cfg map[string]interface{}) { cfg["ssh_password"] = "short" }, true},
+		{func(cfg map[string]interface{}) { cfg["ssh_password"] = strings.Repeat("x", 73) }, true},
+		{func(cfg map[string]interface{}) { cfg["os_type"] = "Windows"; cfg["ssh_password"] = "s3cr3t!" }, true},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
+func TestConfig_Deprovision(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["deprovision_command"] = "waagent -force -deprovision" }, false},
+		{func(cfg map[string]interface{}) { cfg["skip_deprovision"] = true }, false},
+		{func(cfg map[string]interface{}) { cfg["pre_deprovision_commands"] = []string{"history -c"} }, false},
+		{func(cfg map[string]interface{}) {
+			cfg["skip_deprovision"] = true
+			cfg["deprovision_command"] = "waagent"
+		}, true},
+		{func(cfg map[string]interface{}) { cfg["os_type"] = "Windows"; cfg["skip_deprovision"] = true }, true},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
+func TestConfig_SmokeTest(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["smoke_test"] = true }, false},
+		{func(cfg map[string]interface{}) {
+			cfg["smoke_test"] = true
+			cfg["smoke_test_commands"] = []string{"uptime"}
+		}, false},
+		{func(cfg map[string]interface{}) { cfg["smoke_test_commands"] = []string{"uptime"} }, true},
+		{func(cfg map[string]interface{}) { cfg["remove_image_on_smoke_test_failure"] = true }, true},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
+func TestConfig_Journal(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	cfg, _, err := newConfig(getDefaultTestConfig(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OnError != onErrorCleanup || cfg.JournalPath != cfg.tmpVmName+"-journal.json" {
+		t.Fatalf("unexpected defaults: %q %q", cfg.OnError, cfg.JournalPath)
+	}
+
+	if j := newJournal("", cfg); j.AdminPassword != "" {
+		t.Fatal("admin password saved in the journal of a build that cannot be resumed")
+	}
+
+	cfg.OnError = onErrorKeep
+	j := newJournal("", cfg)
+	j.ServiceName = "PkrSrvjournal"
+	j.VmName = "PkrVMjournal"
+	j.UserImageName = "boo_2016-01-02_03-04"
+	journal, err := ioutil.TempFile("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	defer os.Remove(journal.Name())
+	j.path = journal.Name()
+	if err := j.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfgmap := getDefaultTestConfig(f)
+	cfgmap["resume_from_journal"] = journal.Name()
+	cfg, _, err = newConfig(cfgmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.tmpServiceName != "PkrSrvjournal" || cfg.tmpVmName != "PkrVMjournal" || cfg.userImageName != j.UserImageName {
+		t.Fatalf("names of the journal not used: %q %q %q", cfg.tmpServiceName, cfg.tmpVmName, cfg.userImageName)
+	}
+	if cfg.JournalPath != journal.Name() {
+		t.Fatalf("resumed build writes another journal: %q", cfg.JournalPath)
+	}
+
+	// the resources of a build without on_error=keep are removed on error
+	j.OnError = onErrorCleanup
+	cleanedUp, err := ioutil.TempFile("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanedUp.Close()
+	defer os.Remove(cleanedUp.Name())
+	j.path = cleanedUp.Name()
+	if err := j.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["on_error"] = "keep" }, false},
+		{func(cfg map[string]interface{}) { cfg["on_error"] = "abort" }, true},
+		{func(cfg map[string]interface{}) { cfg["resume_from_journal"] = "/does/not/exist" }, true},
+		{func(cfg map[string]interface{}) {
+			cfg["resume_from_journal"] = journal.Name()
+			cfg["journal_path"] = "other.json"
+		}, true},
+		{func(cfg map[string]interface{}) {
+			cfg["resume_from_journal"] = journal.Name()
+			cfg["os_type"] = "Windows"
+		}, true},
+		{func(cfg map[string]interface{}) { cfg["resume_from_journal"] = cleanedUp.Name() }, true},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
+func TestConfig_Placement(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["affinity_group"] = "build-group" }, false},
+		{func(cfg map[string]interface{}) {
+			delete(cfg, "location")
+			cfg["affinity_group"] = "build-group"
+		}, false},
+		{func(cfg map[string]interface{}) { delete(cfg, "location") }, true},
+		{func(cfg map[string]interface{}) { cfg["reserved_ip_name"] = "build-ip" }, false},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
+func TestConfig_DiskCaching(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["os_disk_caching"] = "ReadOnly" }, false},
+		{func(cfg map[string]interface{}) { cfg["os_disk_caching"] = "None" }, true},
+		{func(cfg map[string]interface{}) { cfg["data_disk_caching"] = "ReadWrite" }, false},
+		{func(cfg map[string]interface{}) { cfg["data_disk_caching"] = "readonly" }, true},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
 func TestConfig_VMImageSource(t *testing.T) {
 	f := getTempFile(t)
 	defer os.Remove(f)
@@ -73,6 +334,12 @@ func TestConfig_VMImageSource(t *testing.T) {
 	m["name"] = "Ubuntu-14_04_3-LTS-amd64-server-20160119-en-us-30GB"
 	m["link"] = "http://www.microsoft.com/"
 
+	vhdPath := getTempFile(t)
+	defer os.Remove(vhdPath)
+	if err := ioutil.WriteFile(vhdPath, make([]byte, vhd.SectorSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+
 	tcs := []struct {
 		cfgmod func(map[string]interface{})
 		msg    string
@@ -99,6 +366,13 @@ func TestConfig_VMImageSource(t *testing.T) {
 			delete(cfg, "os_image_label")
 			cfg["remote_source_image_link"] = m["link"]
 		}, "Only link", false},
+		{func(cfg map[string]interface{}) { // label and vhd
+			cfg["source_vhd_path"] = vhdPath
+		}, "Both label and vhd defined", true},
+		{func(cfg map[string]interface{}) { // only source_vhd_path set
+			delete(cfg, "os_image_label")
+			cfg["source_vhd_path"] = vhdPath
+		}, "Only vhd", false},
 	}
 	// Test default config
 	_, _, err := newConfig(getDefaultTestConfig(f))
@@ -115,6 +389,48 @@ func TestConfig_VMImageSource(t *testing.T) {
 	}
 }
 
+func TestConfig_SourceVhdPath(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	cfgmap := getDefaultTestConfig(f)
+	delete(cfgmap, "os_image_label")
+	cfgmap["source_vhd_path"] = f + ".missing"
+	if _, _, err := newConfig(cfgmap); err == nil {
+		t.Fatalf("expected error for missing source_vhd_path")
+	}
+
+	cfgmap["source_vhd_path"] = f
+	if _, _, err := newConfig(cfgmap); err == nil {
+		t.Fatalf("expected error for empty source_vhd_path")
+	}
+
+	footer := vhd.NewFixedFooter(vhd.MiB)
+	if err := ioutil.WriteFile(f, append(make([]byte, vhd.MiB), footer.Bytes()...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := newConfig(cfgmap); err != nil {
+		t.Fatalf("unexpected error for fixed VHD: %v", err)
+	}
+
+	// the checksum is the one's complement of the sum of the bytes without
+	// the checksum field
+	footer.DiskType = vhd.DiskTypeDifferencing
+	footer.Checksum = 0
+	var sum uint32
+	for _, b := range footer.Bytes() {
+		sum += uint32(b)
+	}
+	footer.Checksum = ^sum
+	if err := ioutil.WriteFile(f, append(make([]byte, vhd.MiB), footer.Bytes()...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := newConfig(cfgmap); err == nil || !strings.Contains(err.Error(), "differencing VHD") {
+		t.Fatalf("expected error for differencing VHD, got %v", err)
+	}
+}
+
 // a short test that shows how a mixed-type array is processed by
 // mapstructure
 func TestMapStructureMixedArray(t *testing.T) {
@@ -206,3 +522,32 @@ func (t testLogger) Write(d []byte) (int, error) {
 	t.Logf("log: %s", string(d))
 	return len(d), nil
 }
+
+func TestConfig_StorageAccountAuto(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	cfg, _, err := newConfig(getDefaultTestConfig(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.createStorageAccount || cfg.StorageAccount != "mysa" {
+		t.Errorf("expected existing storage account to be used, got %q (create: %v)", cfg.StorageAccount, cfg.createStorageAccount)
+	}
+
+	cfgmap := getDefaultTestConfig(f)
+	cfgmap["storage_account"] = "auto"
+	cfg, _, err = newConfig(cfgmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPattern := `^pkrsa[0-9a-z]{10}$`
+	if !regexp.MustCompile(expectedPattern).MatchString(cfg.StorageAccount) {
+		t.Errorf("expected %q to match %q", cfg.StorageAccount, expectedPattern)
+	}
+	if !cfg.createStorageAccount {
+		t.Errorf("expected storage account to be created")
+	}
+}
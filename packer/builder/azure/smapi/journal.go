@@ -0,0 +1,547 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/management/hostedservice"
+	"github.com/Azure/azure-sdk-for-go/management/storageservice"
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Values of on_error.
+const (
+	onErrorCleanup = "cleanup"
+	onErrorKeep    = "keep"
+)
+
+// Kinds of journaled resources in addition to the kinds of the sweeper.
+const (
+	KindDeployment     = "deployment"
+	KindOSImage        = "OS image"
+	KindStorageAccount = "storage account"
+)
+
+// journalDeleteOrder is the order in which journaled resources are deleted.
+// Services are deleted first, which releases their disks and VHDs.
+var journalDeleteOrder = []string{
+	KindHostedService,
+	KindDeployment,
+	KindDisk,
+	KindOSImage,
+	KindBlob,
+	KindContainer,
+	KindStorageAccount,
+}
+
+// journalStateKeys are the state values that are saved in the journal of a
+// build that keeps its resources on error, a resumed build needs them to
+// reconnect to the temporary VM.
+var journalStateKeys = []string{
+	constants.Certificate,
+	constants.PrivateKey,
+	constants.Thumbprint,
+	constants.HardDiskName,
+	constants.MediaLink,
+}
+
+// Journal is a local record of the temporary resources of a build. It is
+// saved whenever it changes, so that the resources can be removed or reused
+// by a resumed build after the build failed or Packer died.
+type Journal struct {
+	path string
+
+	Created             time.Time
+	PublishSettingsPath string
+	SubscriptionName    string
+	OSType              string
+	StorageAccount      string
+	ServiceName         string
+	VmName              string
+	ContainerName       string
+	OSImageName         string
+	UserImageName       string
+	OnError             string
+
+	// AdminPassword and State hold the credentials of the temporary VM, they
+	// are only saved if the build keeps its resources on error.
+	AdminPassword string            `json:",omitempty"`
+	State         map[string]string `json:",omitempty"`
+
+	Resources      []JournalResource
+	CompletedSteps []string
+	FailedStep     string `json:",omitempty"`
+
+	currentStep string
+}
+
+// JournalResource is a resource created by a build step.
+type JournalResource struct {
+	Kind string
+	Name string
+	Step string
+}
+
+func (r JournalResource) String() string {
+	return fmt.Sprintf("%s %s", r.Kind, r.Name)
+}
+
+// newJournal returns the journal of a new build.
+func newJournal(path string, c *Config) *Journal {
+	j := &Journal{
+		path:                path,
+		Created:             time.Now().UTC(),
+		PublishSettingsPath: c.PublishSettingsPath,
+		SubscriptionName:    c.SubscriptionName,
+		OSType:              c.OSType,
+		StorageAccount:      c.StorageAccount,
+		ServiceName:         c.tmpServiceName,
+		VmName:              c.tmpVmName,
+		ContainerName:       c.tmpContainerName,
+		OSImageName:         c.tmpOSImageName,
+		UserImageName:       c.userImageName,
+		OnError:             c.OnError,
+	}
+	if j.resumable() {
+		j.AdminPassword = c.tmpAdminPassword
+	}
+	return j
+}
+
+// ReadJournal reads the journal at path.
+func ReadJournal(path string) (*Journal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{path: path}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("%s is not a valid journal: %v", path, err)
+	}
+	return j, nil
+}
+
+// Path returns the path of the journal file.
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Save writes the journal, the file is replaced atomically so that a crash
+// cannot leave a partial journal.
+func (j *Journal) Save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// Remove deletes the journal file.
+func (j *Journal) Remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *Journal) save() {
+	if err := j.Save(); err != nil {
+		log.Printf("Error saving journal %s: %v", j.path, err)
+	}
+}
+
+// addResource records a resource of the current step, it is called before
+// the resource is created.
+func (j *Journal) addResource(kind, name string) {
+	for _, r := range j.Resources {
+		if r.Kind == kind && r.Name == name {
+			return
+		}
+	}
+	j.Resources = append(j.Resources, JournalResource{Kind: kind, Name: name, Step: j.currentStep})
+	j.save()
+}
+
+// resumable returns whether the journaled build keeps its resources on
+// error, so that it can be resumed.
+func (j *Journal) resumable() bool {
+	return j.OnError == onErrorKeep
+}
+
+func (j *Journal) completed(step string) bool {
+	for _, s := range j.CompletedSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// captureState copies the journalStateKeys from state, if the build can be
+// resumed.
+func (j *Journal) captureState(state multistep.StateBag) {
+	if !j.resumable() {
+		return
+	}
+	for _, key := range journalStateKeys {
+		if v, ok := state.GetOk(key); ok {
+			if j.State == nil {
+				j.State = make(map[string]string)
+			}
+			j.State[key] = v.(string)
+		}
+	}
+}
+
+// restoreState sets up state for a resumed build: the saved state values and
+// the complete flags of the steps that are skipped.
+func (j *Journal) restoreState(state multistep.StateBag) {
+	for key, v := range j.State {
+		state.Put(key, v)
+	}
+
+	imageCreated := j.completed(stepName(new(StepCreateImage)))
+	if j.completed(stepName(new(StepCreateService))) {
+		state.Put(constants.SrvExists, 1)
+	}
+	if j.completed(stepName(new(StepUploadCertificate))) {
+		state.Put(constants.CertUploaded, 1)
+	}
+	if j.completed(stepName(new(StepCreateVm))) && !imageCreated {
+		state.Put(constants.VmExists, 1)
+		state.Put(constants.DiskExists, 1)
+	}
+	if imageCreated {
+		state.Put(constants.ImageCreated, 1)
+	}
+}
+
+// cleanedUp removes a step that was cleaned up from the journal, together
+// with its resources that do not exist anymore. Resources that the cleanup
+// did not delete, or that cannot be checked, stay in the journal.
+func (j *Journal) cleanedUp(client management.Client, step string) {
+	var resources []JournalResource
+	for _, r := range j.Resources {
+		if r.Step == step {
+			exists, err := journalResourceExists(client, r)
+			if err != nil {
+				log.Printf("Error checking %s: %v", r, err)
+			}
+			if !exists && err == nil {
+				continue
+			}
+		}
+		resources = append(resources, r)
+	}
+	j.Resources = resources
+
+	var steps []string
+	for _, s := range j.CompletedSteps {
+		if s != step {
+			steps = append(steps, s)
+		}
+	}
+	j.CompletedSteps = steps
+	j.save()
+}
+
+// discardUnfinished deletes the resources of the steps that did not
+// complete and are run again by the resumed build, except for the steps in
+// keep which reuse their resources.
+func (j *Journal) discardUnfinished(client management.Client, ui packer.Ui, keep map[string]bool) error {
+	var discard, resources []JournalResource
+	for _, r := range j.Resources {
+		if j.completed(r.Step) || keep[r.Step] {
+			resources = append(resources, r)
+		} else {
+			discard = append(discard, r)
+		}
+	}
+
+	for _, r := range sortJournalResources(discard) {
+		ui.Message(fmt.Sprintf("Removing %s left by %s...", r, r.Step))
+		if err := deleteJournalResource(client, r); err != nil {
+			return fmt.Errorf("Error removing %s: %v", r, err)
+		}
+	}
+
+	j.Resources = resources
+	j.FailedStep = ""
+	j.save()
+	return nil
+}
+
+// DeleteResources deletes the journaled resources, report is called for
+// every resource. The resources that were deleted are removed from the
+// journal, an error is returned if any resource could not be deleted.
+func (j *Journal) DeleteResources(client management.Client, report func(JournalResource, error)) error {
+	var failed []JournalResource
+	for _, r := range sortJournalResources(j.Resources) {
+		err := deleteJournalResource(client, r)
+		if err != nil {
+			failed = append(failed, r)
+		}
+		report(r, err)
+	}
+
+	j.Resources = failed
+	if err := j.Save(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of the journaled resources could not be deleted", len(failed))
+	}
+	return nil
+}
+
+func sortJournalResources(resources []JournalResource) []JournalResource {
+	var sorted []JournalResource
+	for _, kind := range journalDeleteOrder {
+		for _, r := range resources {
+			if r.Kind == kind {
+				sorted = append(sorted, r)
+			}
+		}
+	}
+	return sorted
+}
+
+// deleteJournalResource deletes r, resources that do not exist anymore are
+// ignored. Deployments are named service/deployment, blobs
+// account/container/blob and containers account/container.
+func deleteJournalResource(client management.Client, r JournalResource) error {
+	parts := strings.Split(r.Name, "/")
+
+	switch r.Kind {
+	case KindHostedService:
+		return ignoreNotFound(retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+			return hostedservice.NewClient(client).DeleteHostedService(r.Name, true)
+		}))
+	case KindDeployment:
+		if len(parts) != 2 {
+			break
+		}
+		return ignoreNotFound(retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+			return vm.NewClient(client).DeleteDeployment(parts[0], parts[1])
+		}))
+	case KindDisk:
+		return deleteDisk(client, r.Name, true)
+	case KindOSImage:
+		return ignoreNotFound(DeleteOSImage(client, r.Name, true))
+	case KindBlob, KindContainer:
+		if (r.Kind == KindBlob && len(parts) < 3) || (r.Kind == KindContainer && len(parts) != 2) {
+			break
+		}
+		blobService, err := journalBlobService(client, parts[0])
+		if err != nil {
+			return ignoreNotFound(err)
+		}
+		return retry.ExecuteOperation(func() error {
+			if r.Kind == KindContainer {
+				_, err := blobService.DeleteContainerIfExists(parts[1])
+				return err
+			}
+			_, err := blobService.DeleteBlobIfExists(parts[1], strings.Join(parts[2:], "/"), nil)
+			return err
+		})
+	case KindStorageAccount:
+		return ignoreNotFound(retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+			return storageservice.NewClient(client).DeleteStorageService(r.Name)
+		}))
+	}
+	return fmt.Errorf("unknown journal resource %s", r)
+}
+
+func journalBlobService(client management.Client, account string) (storage.BlobStorageClient, error) {
+	// the error is not wrapped, the resource is gone with its account
+	keys, err := storageservice.NewClient(client).GetStorageServiceKeys(account)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+	storageClient, err := storage.NewBasicClient(account, keys.PrimaryKey)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+	return storageClient.GetBlobService(), nil
+}
+
+// journalRelease removes a resource that is not temporary anymore from the
+// journal of the build, if any.
+func journalRelease(state multistep.StateBag, kind, name string) {
+	j, ok := state.GetOk(constants.Journal)
+	if !ok {
+		return
+	}
+	journal := j.(*Journal)
+	var resources []JournalResource
+	for _, r := range journal.Resources {
+		if r.Kind != kind || r.Name != name {
+			resources = append(resources, r)
+		}
+	}
+	journal.Resources = resources
+	journal.save()
+}
+
+// journalResourceExists returns whether r still exists.
+func journalResourceExists(client management.Client, r JournalResource) (bool, error) {
+	parts := strings.Split(r.Name, "/")
+
+	var url string
+	switch r.Kind {
+	case KindHostedService:
+		url = "services/hostedservices/" + r.Name
+	case KindDeployment:
+		if len(parts) != 2 {
+			break
+		}
+		url = fmt.Sprintf("services/hostedservices/%s/deployments/%s", parts[0], parts[1])
+	case KindDisk:
+		url = "services/disks/" + r.Name
+	case KindOSImage:
+		url = "services/images/" + r.Name
+	case KindStorageAccount:
+		url = "services/storageservices/" + r.Name
+	case KindBlob, KindContainer:
+		if (r.Kind == KindBlob && len(parts) < 3) || (r.Kind == KindContainer && len(parts) != 2) {
+			break
+		}
+		blobService, err := journalBlobService(client, parts[0])
+		if management.IsResourceNotFoundError(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if r.Kind == KindContainer {
+			return blobService.ContainerExists(parts[1])
+		}
+		return blobService.BlobExists(parts[1], strings.Join(parts[2:], "/"))
+	}
+	if url == "" {
+		return false, fmt.Errorf("unknown journal resource %s", r)
+	}
+
+	_, err := client.SendAzureGetRequest(url)
+	if management.IsResourceNotFoundError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// journalResource records a resource in the journal of the build, if any.
+func journalResource(state multistep.StateBag, kind, name string) {
+	if j, ok := state.GetOk(constants.Journal); ok {
+		j.(*Journal).addResource(kind, name)
+	}
+}
+
+// stepName returns the package qualified type name of step.
+func stepName(step multistep.Step) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", step), "*")
+}
+
+// resumableStep is implemented by steps whose cleanup depends on what their
+// Run did. Resume is called instead of Run when a resumed build skips the
+// step.
+type resumableStep interface {
+	Resume(state multistep.StateBag)
+}
+
+// journaledStep records the progress of a step in the journal.
+type journaledStep struct {
+	multistep.Step
+
+	journal *Journal
+	name    string
+
+	// resume skips the step if it completed in the journaled build, unless
+	// rerun is set.
+	resume bool
+	rerun  bool
+
+	// keepOnError skips the cleanup of a failed build.
+	keepOnError bool
+}
+
+func (s *journaledStep) Run(state multistep.StateBag) multistep.StepAction {
+	s.journal.currentStep = s.name
+
+	if s.resume && !s.rerun && s.journal.completed(s.name) {
+		log.Printf("Resume: skipping %s", s.name)
+		if r, ok := s.Step.(resumableStep); ok {
+			r.Resume(state)
+		}
+		return multistep.ActionContinue
+	}
+
+	action := s.Step.Run(state)
+
+	s.journal.captureState(state)
+	if action == multistep.ActionContinue {
+		if !s.journal.completed(s.name) {
+			s.journal.CompletedSteps = append(s.journal.CompletedSteps, s.name)
+		}
+	} else if _, failed := state.GetOk("error"); failed {
+		s.journal.FailedStep = s.name
+	}
+	s.journal.save()
+
+	return action
+}
+
+func (s *journaledStep) Cleanup(state multistep.StateBag) {
+	_, failed := state.GetOk("error")
+	if failed && s.keepOnError {
+		log.Printf("Keeping the resources of %s", s.name)
+		return
+	}
+	s.Step.Cleanup(state)
+	if failed {
+		s.journal.cleanedUp(state.Get(constants.RequestManager).(management.Client), s.name)
+	}
+}
+
+// journalPauseFn passes the name of the wrapped step to pauseFn rather than
+// that of journaledStep. Every pause before a cleanup belongs to the step
+// of the latest pause after a run that was not cleaned up.
+func journalPauseFn(j *Journal, pauseFn multistep.DebugPauseFn) multistep.DebugPauseFn {
+	var names []string
+	return func(loc multistep.DebugLocation, name string, state multistep.StateBag) {
+		switch loc {
+		case multistep.DebugLocationAfterRun:
+			name = j.currentStep
+			names = append(names, name)
+		case multistep.DebugLocationBeforeCleanup:
+			if n := len(names); n > 0 {
+				name = names[n-1]
+				names = names[:n-1]
+			}
+		}
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		pauseFn(loc, name, state)
+	}
+}
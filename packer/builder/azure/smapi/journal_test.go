@@ -0,0 +1,192 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+
+	"github.com/mitchellh/multistep"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+)
+
+type testStep struct {
+	action   multistep.StepAction
+	ran      bool
+	cleaned  bool
+	resumed  bool
+	resource string
+}
+
+func (s *testStep) Run(state multistep.StateBag) multistep.StepAction {
+	s.ran = true
+	if s.resource != "" {
+		journalResource(state, KindDisk, s.resource)
+	}
+	if s.action == multistep.ActionHalt {
+		state.Put("error", "failed")
+	}
+	return s.action
+}
+
+func (s *testStep) Cleanup(state multistep.StateBag) { s.cleaned = true }
+
+func (s *testStep) Resume(state multistep.StateBag) { s.resumed = true }
+
+// existsClient answers GET requests for the existing urls, other resources
+// are not found.
+type existsClient struct {
+	management.Client
+	existing map[string]bool
+}
+
+func (c *existsClient) SendAzureGetRequest(url string) ([]byte, error) {
+	if !c.existing[url] {
+		return nil, management.AzureError{Code: "ResourceNotFound"}
+	}
+	return nil, nil
+}
+
+func testJournal(t *testing.T) *Journal {
+	f, err := ioutil.TempFile("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return &Journal{path: f.Name()}
+}
+
+func TestJournaledStep(t *testing.T) {
+	j := testJournal(t)
+	defer j.Remove()
+	j.OnError = onErrorKeep
+
+	state := new(multistep.BasicStateBag)
+	state.Put(constants.Journal, j)
+	state.Put(constants.Thumbprint, "ABCD")
+
+	ok := &journaledStep{Step: &testStep{resource: "PkrVMdisk"}, journal: j, name: "ok", keepOnError: true}
+	failed := &journaledStep{Step: &testStep{action: multistep.ActionHalt}, journal: j, name: "failed", keepOnError: true}
+	(&multistep.BasicRunner{Steps: []multistep.Step{ok, failed}}).Run(state)
+
+	if ok.Step.(*testStep).cleaned || failed.Step.(*testStep).cleaned {
+		t.Fatal("expected the steps to keep their resources")
+	}
+
+	saved, err := ReadJournal(j.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.CompletedSteps, []string{"ok"}) || saved.FailedStep != "failed" {
+		t.Fatalf("unexpected progress: %v %q", saved.CompletedSteps, saved.FailedStep)
+	}
+	if !reflect.DeepEqual(saved.Resources, []JournalResource{{Kind: KindDisk, Name: "PkrVMdisk", Step: "ok"}}) {
+		t.Fatalf("unexpected resources: %v", saved.Resources)
+	}
+	if saved.State[constants.Thumbprint] != "ABCD" {
+		t.Fatalf("state not saved: %v", saved.State)
+	}
+
+	// the resumed build skips the completed step and runs the failed step
+	state = new(multistep.BasicStateBag)
+	saved.restoreState(state)
+	skipped := &journaledStep{Step: new(testStep), journal: saved, name: "ok", resume: true}
+	rerun := &journaledStep{Step: new(testStep), journal: saved, name: "ok", resume: true, rerun: true}
+	retried := &journaledStep{Step: new(testStep), journal: saved, name: "failed", resume: true}
+	(&multistep.BasicRunner{Steps: []multistep.Step{skipped, rerun, retried}}).Run(state)
+
+	if s := skipped.Step.(*testStep); s.ran || !s.resumed {
+		t.Fatal("expected the completed step to be resumed, not run")
+	}
+	if !rerun.Step.(*testStep).ran || !retried.Step.(*testStep).ran {
+		t.Fatal("expected the rerun and the failed step to run")
+	}
+	if v := state.Get(constants.Thumbprint); v != "ABCD" {
+		t.Fatalf("state not restored: %v", v)
+	}
+}
+
+func TestJournaledStep_Cleanup(t *testing.T) {
+	j := testJournal(t)
+	defer j.Remove()
+	j.OnError = onErrorCleanup
+
+	// the cleanup of the second step fails to delete its disk
+	state := new(multistep.BasicStateBag)
+	state.Put(constants.Journal, j)
+	state.Put(constants.Thumbprint, "ABCD")
+	state.Put(constants.RequestManager, &existsClient{existing: map[string]bool{"services/disks/PkrVMleft": true}})
+
+	ok := &journaledStep{Step: &testStep{resource: "PkrVMdisk"}, journal: j, name: "ok"}
+	left := &journaledStep{Step: &testStep{resource: "PkrVMleft"}, journal: j, name: "left"}
+	failed := &journaledStep{Step: &testStep{action: multistep.ActionHalt}, journal: j, name: "failed"}
+	(&multistep.BasicRunner{Steps: []multistep.Step{ok, left, failed}}).Run(state)
+
+	if !ok.Step.(*testStep).cleaned || !left.Step.(*testStep).cleaned {
+		t.Fatal("expected the completed steps to be cleaned up")
+	}
+
+	saved, err := ReadJournal(j.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.CompletedSteps) != 0 {
+		t.Fatalf("cleaned up steps left in the journal: %v", saved.CompletedSteps)
+	}
+	if !reflect.DeepEqual(saved.Resources, []JournalResource{{Kind: KindDisk, Name: "PkrVMleft", Step: "left"}}) {
+		t.Fatalf("expected only the resource that was not deleted in the journal: %v", saved.Resources)
+	}
+	if len(saved.State) != 0 || saved.AdminPassword != "" {
+		t.Fatalf("credentials saved in the journal of a build that cannot be resumed: %v", saved.State)
+	}
+}
+
+func TestSortJournalResources(t *testing.T) {
+	resources := []JournalResource{
+		{Kind: KindContainer, Name: "sa/packer-provision-x"},
+		{Kind: KindDisk, Name: "PkrVMx"},
+		{Kind: KindHostedService, Name: "PkrSrvx"},
+		{Kind: KindStorageAccount, Name: "pkrsax"},
+		{Kind: KindDeployment, Name: "PkrSrvx/PkrVMx"},
+	}
+
+	var kinds []string
+	for _, r := range sortJournalResources(resources) {
+		kinds = append(kinds, r.Kind)
+	}
+	expected := []string{KindHostedService, KindDeployment, KindDisk, KindContainer, KindStorageAccount}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("expected %v, got %v", expected, kinds)
+	}
+}
+
+func TestJournalPauseFn(t *testing.T) {
+	j := &Journal{}
+	var names []string
+	pause := journalPauseFn(j, func(loc multistep.DebugLocation, name string, state multistep.StateBag) {
+		names = append(names, name)
+	})
+
+	for _, step := range []string{"azure.StepValidate", "lin.StepCreateCert"} {
+		j.currentStep = step
+		pause(multistep.DebugLocationAfterRun, "journaledStep", nil)
+	}
+	pause(multistep.DebugLocationBeforeCleanup, "journaledStep", nil)
+	pause(multistep.DebugLocationBeforeCleanup, "journaledStep", nil)
+
+	expected := []string{"StepValidate", "StepCreateCert", "StepCreateCert", "StepValidate"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestStepName(t *testing.T) {
+	if name := stepName(new(StepCreateService)); name != "azure.StepCreateService" {
+		t.Fatalf("unexpected step name %q", name)
+	}
+}
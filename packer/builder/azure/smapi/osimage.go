@@ -0,0 +1,54 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+)
+
+// The osimage package of the SDK can only list OS images, these are the
+// operations it lacks.
+const (
+	azureOSImageListURL   = "services/images"
+	azureOSImageDeleteURL = "services/images/%s"
+)
+
+// OSImageParameters describes an OS image to register. The order of the
+// fields matches the order the API expects.
+type OSImageParameters struct {
+	XMLName     xml.Name `xml:"http://schemas.microsoft.com/windowsazure OSImage"`
+	Label       string
+	MediaLink   string
+	Name        string
+	OS          string
+	Description string `xml:",omitempty"`
+	ImageFamily string `xml:",omitempty"`
+}
+
+// RegisterOSImage registers a VHD blob as an OS image.
+func RegisterOSImage(client management.Client, params OSImageParameters) error {
+	data, err := xml.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return client.SendAzurePostRequest(azureOSImageListURL, data)
+	})
+}
+
+// DeleteOSImage removes an OS image, deleteMedia also removes the VHD blob.
+func DeleteOSImage(client management.Client, name string, deleteMedia bool) error {
+	url := fmt.Sprintf(azureOSImageDeleteURL, name)
+	if deleteMedia {
+		url += "?comp=media"
+	}
+	return retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return client.SendAzureDeleteRequest(url)
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+
+	vmdisk "github.com/Azure/azure-sdk-for-go/management/virtualmachinedisk"
+)
+
+const accountTypePremiumLRS = "Premium_LRS"
+
+// premiumSizeRegex matches the DS, DSv2, GS and Fs-series sizes, which can
+// use premium storage.
+var premiumSizeRegex = regexp.MustCompile(`^(?i)Standard_(DS\d+(_v2)?|GS\d+|F\d+s)$`)
+
+// premiumTiers are the sizes of premium disks, disks are billed as the next
+// larger tier.
+var premiumTiers = []struct {
+	Name   string
+	SizeGB int
+}{
+	{"P10", 128},
+	{"P20", 512},
+	{"P30", 1023},
+}
+
+func isPremiumSize(instanceSize string) bool {
+	return premiumSizeRegex.MatchString(instanceSize)
+}
+
+// premiumTier returns the tier a disk of sizeGB is billed as.
+func premiumTier(sizeGB int) (string, int, error) {
+	for _, t := range premiumTiers {
+		if sizeGB <= t.SizeGB {
+			return t.Name, t.SizeGB, nil
+		}
+	}
+	return "", 0, fmt.Errorf("disks on premium storage cannot be larger than %d GB", premiumTiers[len(premiumTiers)-1].SizeGB)
+}
+
+// validateDiskCaching checks the host caching of the OS and the data disks.
+func validateDiskCaching(osDiskCaching, dataDiskCaching string) error {
+	switch vmdisk.HostCachingType(osDiskCaching) {
+	case vmdisk.HostCachingTypeReadOnly, vmdisk.HostCachingTypeReadWrite:
+	default:
+		return fmt.Errorf("os_disk_caching must be %s or %s", vmdisk.HostCachingTypeReadOnly, vmdisk.HostCachingTypeReadWrite)
+	}
+	switch vmdisk.HostCachingType(dataDiskCaching) {
+	case vmdisk.HostCachingTypeNone, vmdisk.HostCachingTypeReadOnly, vmdisk.HostCachingTypeReadWrite:
+	default:
+		return fmt.Errorf("data_disk_caching must be %s, %s or %s", vmdisk.HostCachingTypeNone, vmdisk.HostCachingTypeReadOnly, vmdisk.HostCachingTypeReadWrite)
+	}
+	return nil
+}
+
+// validatePremiumStorage checks the build against the storage account type.
+// It returns the premium tiers of the disks.
+func validatePremiumStorage(config *Config, accountType string) ([]string, error) {
+	if accountType != accountTypePremiumLRS {
+		return nil, nil
+	}
+
+	if !isPremiumSize(config.InstanceSize) {
+		return nil, fmt.Errorf("Storage account %q is a %s account, instance size %q cannot use premium storage, use a DS, GS or Fs-series size",
+			config.StorageAccount, accountType, config.InstanceSize)
+	}
+	if config.OSType == constants.Target_Windows {
+		return nil, fmt.Errorf("Storage account %q is a %s account, it cannot hold the block blobs of Windows provisioning",
+			config.StorageAccount, accountType)
+	}
+
+	var tiers []string
+	if config.ResizeOSVhdGB != nil {
+		tier, size, err := premiumTier(*config.ResizeOSVhdGB)
+		if err != nil {
+			return nil, fmt.Errorf("OS disk of %d GB: %v", *config.ResizeOSVhdGB, err)
+		}
+		tiers = append(tiers, fmt.Sprintf("OS disk of %d GB is a %s disk of %d GB", *config.ResizeOSVhdGB, tier, size))
+	}
+	for n, d := range config.DataDisks {
+		sizeGB, ok := d.(int)
+		if !ok {
+			continue
+		}
+		tier, size, err := premiumTier(sizeGB)
+		if err != nil {
+			return nil, fmt.Errorf("Data disk # %d of %d GB: %v", n, sizeGB, err)
+		}
+		tiers = append(tiers, fmt.Sprintf("Data disk # %d of %d GB is a %s disk of %d GB", n, sizeGB, tier, size))
+	}
+	return tiers, nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+)
+
+func TestIsPremiumSize(t *testing.T) {
+	for size, expected := range map[string]bool{
+		"Standard_DS1":    true,
+		"Standard_DS14":   true,
+		"Standard_DS2_v2": true,
+		"Standard_GS5":    true,
+		"Standard_F4s":    true,
+		"standard_ds3":    true,
+		"Standard_D1":     false,
+		"Standard_F4":     false,
+		"Large":           false,
+	} {
+		if isPremiumSize(size) != expected {
+			t.Errorf("isPremiumSize(%q) should be %v", size, expected)
+		}
+	}
+}
+
+func TestValidatePremiumStorage(t *testing.T) {
+	resize := 200
+	tcs := []struct {
+		accountType  string
+		instanceSize string
+		osType       string
+		dataDisks    []interface{}
+		tiers        []string
+		err          bool
+	}{
+		{"Standard_LRS", "Large", constants.Target_Linux, []interface{}{2048}, nil, false},
+		{"Premium_LRS", "Large", constants.Target_Linux, nil, nil, true},
+		{"Premium_LRS", "Standard_DS2", constants.Target_Windows, nil, nil, true},
+		{"Premium_LRS", "Standard_DS2", constants.Target_Linux, []interface{}{100, "https://sa.blob.core.windows.net/vhds/data.vhd", 513}, []string{
+			"OS disk of 200 GB is a P20 disk of 512 GB",
+			"Data disk # 0 of 100 GB is a P10 disk of 128 GB",
+			"Data disk # 2 of 513 GB is a P30 disk of 1023 GB",
+		}, false},
+		{"Premium_LRS", "Standard_GS1", constants.Target_Linux, []interface{}{1024}, nil, true},
+	}
+
+	for _, tc := range tcs {
+		config := &Config{
+			StorageAccount: "mysa",
+			InstanceSize:   tc.instanceSize,
+			OSType:         tc.osType,
+			DataDisks:      tc.dataDisks,
+		}
+		if tc.accountType == accountTypePremiumLRS {
+			config.ResizeOSVhdGB = &resize
+		}
+
+		tiers, err := validatePremiumStorage(config, tc.accountType)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value for %+v: %v", tc, err)
+		}
+		if !reflect.DeepEqual(tiers, tc.tiers) {
+			t.Fatalf("expected %v, got %v", tc.tiers, tiers)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+
+	"github.com/Azure/azure-sdk-for-go/management"
 )
 
 func findSubscriptionID(publishSettingsPath, subscriptionName string) (string, error) {
@@ -31,3 +33,17 @@ func findSubscriptionID(publishSettingsPath, subscriptionName string) (string, e
 
 	return "", fmt.Errorf("Subscription with name %q not found in %s", subscriptionName, publishSettingsPath)
 }
+
+// ClientFromPublishSettings creates a Service Management client for the
+// subscription with the given name.
+func ClientFromPublishSettings(publishSettingsPath, subscriptionName string) (management.Client, error) {
+	subscriptionID, err := findSubscriptionID(publishSettingsPath, subscriptionName)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating new Azure client: %v", err)
+	}
+	client, err := management.ClientFromPublishSettingsFile(publishSettingsPath, subscriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating new Azure client: %v", err)
+	}
+	return GetLoggedClient(client), nil
+}
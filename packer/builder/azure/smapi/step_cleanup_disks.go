@@ -0,0 +1,197 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+	vmdisk "github.com/Azure/azure-sdk-for-go/management/virtualmachinedisk"
+)
+
+// StepCleanupDisks runs before the temporary service is created and only
+// journals the VHDs of the VM. On cleanup of a failed build, after the
+// service was removed, it deletes the disks and VHDs of the VM that are left
+// and reports those it could not delete.
+type StepCleanupDisks struct {
+	TmpServiceName string
+}
+
+// vmVhd is a VHD of the temporary VM.
+type vmVhd struct {
+	MediaLink string
+	DiskName  string
+
+	// existed is set for data disks attached from a VHD of the user, which
+	// is not deleted.
+	existed bool
+}
+
+func (s *StepCleanupDisks) Run(state multistep.StateBag) multistep.StepAction {
+	for _, v := range vmVhds(state) {
+		if b, err := common.ParseBlobURL(v.MediaLink); err == nil && !v.existed {
+			journalResource(state, KindBlob, fmt.Sprintf("%s/%s/%s", b.StorageAccount, b.Container, b.Blob))
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *StepCleanupDisks) Cleanup(state multistep.StateBag) {
+	if !common.IsStateFailed(state) {
+		return
+	}
+	if res, ok := state.GetOk(constants.ImageCreated); ok && res.(int) == 1 {
+		// the VHDs belong to the image now
+		for _, v := range vmVhds(state) {
+			if b, err := common.ParseBlobURL(v.MediaLink); err == nil {
+				journalRelease(state, KindBlob, fmt.Sprintf("%s/%s/%s", b.StorageAccount, b.Container, b.Blob))
+			}
+		}
+		return
+	}
+
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+
+	vhds := vmVhds(state)
+	if len(vhds) == 0 {
+		return
+	}
+
+	ui.Say("Removing disks and VHDs of the temporary Azure VM...")
+
+	var failed []string
+	disks, err := vmdisk.NewClient(client).ListDisks()
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error listing disks: %s", err))
+		failed = append(failed, "disks")
+	}
+
+	for _, d := range findVmDisks(disks.Disk, s.TmpServiceName, vhds) {
+		ui.Message(fmt.Sprintf("Removing disk %s...", d.DiskName))
+		if err := deleteDisk(client, d.DiskName, !d.existed); err != nil {
+			ui.Error(fmt.Sprintf("Error removing disk %s: %s", d.DiskName, err))
+			failed = append(failed, "disk "+d.DiskName)
+		}
+	}
+
+	for _, v := range vhds {
+		if v.existed || v.MediaLink == "" {
+			continue
+		}
+		if err := deleteVhd(client, v.MediaLink); err != nil {
+			ui.Error(fmt.Sprintf("Error removing VHD %s: %s", v.MediaLink, err))
+			failed = append(failed, "VHD "+v.MediaLink)
+		}
+	}
+
+	if len(failed) > 0 {
+		ui.Error(fmt.Sprintf("Could not remove %s, remove them manually", strings.Join(failed, ", ")))
+	}
+}
+
+// vmVhds returns the OS and data VHDs of the VM, as configured in the role
+// and as reported by the deployment.
+func vmVhds(state multistep.StateBag) []vmVhd {
+	var vhds []vmVhd
+	add := func(v vmVhd) {
+		for i := range vhds {
+			if v.MediaLink != "" && strings.EqualFold(vhds[i].MediaLink, v.MediaLink) {
+				if vhds[i].DiskName == "" {
+					vhds[i].DiskName = v.DiskName
+				}
+				return
+			}
+		}
+		vhds = append(vhds, v)
+	}
+
+	if role, ok := state.GetOk("role"); ok {
+		role := role.(*vm.Role)
+		if role.OSVirtualHardDisk != nil && role.OSVirtualHardDisk.MediaLink != "" {
+			add(vmVhd{MediaLink: role.OSVirtualHardDisk.MediaLink})
+		}
+		for _, d := range role.DataVirtualHardDisks {
+			if d.SourceMediaLink != "" {
+				add(vmVhd{MediaLink: d.SourceMediaLink, existed: true})
+			} else if d.MediaLink != "" {
+				add(vmVhd{MediaLink: d.MediaLink})
+			}
+		}
+	}
+
+	osDisk := vmVhd{}
+	if v, ok := state.GetOk(constants.MediaLink); ok {
+		osDisk.MediaLink = v.(string)
+	}
+	if v, ok := state.GetOk(constants.HardDiskName); ok {
+		osDisk.DiskName = v.(string)
+	}
+	if osDisk.MediaLink != "" || osDisk.DiskName != "" {
+		add(osDisk)
+	}
+	if v, ok := state.GetOk(constants.DataDisks); ok {
+		for _, d := range v.([]vm.DataVirtualHardDisk) {
+			add(vmVhd{MediaLink: d.MediaLink, DiskName: d.DiskName})
+		}
+	}
+	return vhds
+}
+
+// findVmDisks returns the registered disks of the VM: disks still attached
+// to its service and disks with the name or the VHD of vhds.
+func findVmDisks(disks []vmdisk.DiskResponse, serviceName string, vhds []vmVhd) []vmVhd {
+	var found []vmVhd
+	for _, d := range disks {
+		disk := vmVhd{MediaLink: d.MediaLink, DiskName: d.Name}
+		match := d.AttachedTo.HostedServiceName == serviceName
+		for _, v := range vhds {
+			if (v.DiskName != "" && v.DiskName == d.Name) || (v.MediaLink != "" && strings.EqualFold(v.MediaLink, d.MediaLink)) {
+				match = true
+				disk.existed = disk.existed || v.existed
+			}
+		}
+		if match {
+			found = append(found, disk)
+		}
+	}
+	return found
+}
+
+// deleteDisk deletes a disk and optionally its VHD, retrying while the disk
+// is still in use by the deployment that is being removed.
+func deleteDisk(client management.Client, name string, deleteVhd bool) error {
+	return ignoreNotFound(retry.ExecuteOperation(func() error {
+		return vmdisk.NewClient(client).DeleteDisk(name, deleteVhd)
+	}, retry.ConstantBackoffRule("busy", func(err management.AzureError) bool {
+		return strings.Contains(err.Message, "is currently performing an operation on deployment") ||
+			strings.Contains(err.Message, "is currently in use by virtual machine")
+	}, 30*time.Second, 10)))
+}
+
+// deleteVhd deletes the blob at mediaLink if it exists.
+func deleteVhd(client management.Client, mediaLink string) error {
+	b, err := common.ParseBlobURL(mediaLink)
+	if err != nil {
+		return err
+	}
+	storageClient, err := StorageClientForBlob(client, b)
+	if err != nil {
+		return err
+	}
+	return retry.ExecuteOperation(func() error {
+		_, err := storageClient.GetBlobService().DeleteBlobIfExists(b.Container, b.Blob, nil)
+		return err
+	})
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+
+	"github.com/mitchellh/multistep"
+
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+	vmdisk "github.com/Azure/azure-sdk-for-go/management/virtualmachinedisk"
+)
+
+const testVhdPrefix = "https://sa.blob.core.windows.net/vhds/"
+
+func testCleanupState() multistep.StateBag {
+	role := &vm.Role{
+		OSVirtualHardDisk: &vm.OSVirtualHardDisk{MediaLink: testVhdPrefix + "PkrVMx.vhd"},
+		DataVirtualHardDisks: []vm.DataVirtualHardDisk{
+			{MediaLink: testVhdPrefix + "PkrVMx-data-0.vhd", LogicalDiskSizeInGB: 10},
+			{SourceMediaLink: testVhdPrefix + "existing.vhd"},
+		},
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("role", role)
+	state.Put(constants.HardDiskName, "PkrSrvx-PkrVMx-0-201601020304050607")
+	state.Put(constants.MediaLink, testVhdPrefix+"PkrVMx.vhd")
+	state.Put(constants.DataDisks, []vm.DataVirtualHardDisk{
+		{DiskName: "PkrSrvx-PkrVMx-1-201601020304050607", MediaLink: testVhdPrefix + "PkrVMx-data-0.vhd"},
+		{DiskName: "PkrSrvx-PkrVMx-2-201601020304050607", MediaLink: testVhdPrefix + "existing.vhd"},
+	})
+	return state
+}
+
+func TestVmVhds(t *testing.T) {
+	expected := []vmVhd{
+		{MediaLink: testVhdPrefix + "PkrVMx.vhd", DiskName: "PkrSrvx-PkrVMx-0-201601020304050607"},
+		{MediaLink: testVhdPrefix + "PkrVMx-data-0.vhd", DiskName: "PkrSrvx-PkrVMx-1-201601020304050607"},
+		{MediaLink: testVhdPrefix + "existing.vhd", DiskName: "PkrSrvx-PkrVMx-2-201601020304050607", existed: true},
+	}
+
+	if vhds := vmVhds(testCleanupState()); !reflect.DeepEqual(vhds, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, vhds)
+	}
+}
+
+func TestFindVmDisks(t *testing.T) {
+	disks := []vmdisk.DiskResponse{
+		{Name: "PkrSrvx-PkrVMx-0-201601020304050607", MediaLink: testVhdPrefix + "PkrVMx.vhd"},
+		{Name: "PkrSrvx-PkrVMx-2-201601020304050607", MediaLink: testVhdPrefix + "existing.vhd"},
+		{Name: "other", MediaLink: testVhdPrefix + "other.vhd"},
+		{Name: "attached", MediaLink: testVhdPrefix + "attached.vhd", AttachedTo: vmdisk.Resource{HostedServiceName: "PkrSrvx"}},
+		{Name: "renamed", MediaLink: "HTTPS://SA.BLOB.CORE.WINDOWS.NET/vhds/PkrVMx-data-0.vhd"},
+	}
+
+	expected := []vmVhd{
+		{MediaLink: testVhdPrefix + "PkrVMx.vhd", DiskName: "PkrSrvx-PkrVMx-0-201601020304050607"},
+		{MediaLink: testVhdPrefix + "existing.vhd", DiskName: "PkrSrvx-PkrVMx-2-201601020304050607", existed: true},
+		{MediaLink: testVhdPrefix + "attached.vhd", DiskName: "attached"},
+		{MediaLink: "HTTPS://SA.BLOB.CORE.WINDOWS.NET/vhds/PkrVMx-data-0.vhd", DiskName: "renamed"},
+	}
+
+	if found := findVmDisks(disks, "PkrSrvx", vmVhds(testCleanupState())); !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, found)
+	}
+}
+
+func TestStepCleanupDisks_KeepsImageVhds(t *testing.T) {
+	state := testCleanupState()
+	state.Put(multistep.StateHalted, true)
+	state.Put(constants.ImageCreated, 1)
+
+	// the client would panic if it was used
+	state.Put(constants.RequestManager, new(postClient))
+	new(StepCleanupDisks).Cleanup(state)
+}
@@ -5,8 +5,6 @@ package azure
 
 import (
 	"fmt"
-	"strings"
-	"time"
 
 	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
 	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
@@ -15,7 +13,6 @@ import (
 	"github.com/mitchellh/packer/packer"
 
 	"github.com/Azure/azure-sdk-for-go/management"
-	vmdisk "github.com/Azure/azure-sdk-for-go/management/virtualmachinedisk"
 	vmi "github.com/Azure/azure-sdk-for-go/management/virtualmachineimage"
 )
 
@@ -30,12 +27,13 @@ type StepCreateImage struct {
 func (s *StepCreateImage) Run(state multistep.StateBag) multistep.StepAction {
 	client := state.Get(constants.RequestManager).(management.Client)
 	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
 
 	errorMsg := "Error Creating Azure Image: %s"
 
 	ui.Say("Creating Azure Image. If Successful, This Will Remove the Temporary VM...")
 
-	description := "packer made image"
+	description := config.metadata.description()
 	imageFamily := "PackerMade"
 
 	if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
@@ -63,33 +61,26 @@ func (s *StepCreateImage) Cleanup(state multistep.StateBag) {
 	client := state.Get(constants.RequestManager).(management.Client)
 	ui := state.Get(constants.Ui).(packer.Ui)
 
-	var err error
-	var res int
-
-	if res = state.Get(constants.VmExists).(int); res == 1 { //VM was not removed at image creation step
+	if res := state.Get(constants.VmExists).(int); res == 1 { //VM was not removed at image creation step
 		return
 	}
 
-	// Since VM was successfully removed - remove it's media as well
+	// Since VM was successfully removed - remove it's media as well, the
+	// other disks of a failed build are removed by StepCleanupDisks
 
-	if res = state.Get(constants.DiskExists).(int); res == 1 {
+	if res, ok := state.GetOk(constants.DiskExists); ok && res.(int) == 1 {
 		ui.Message("Removing Temporary Azure Disk...")
 		errorMsg := "Error Removing Temporary Azure Disk: %s"
 
 		diskName, ok := state.Get(constants.HardDiskName).(string)
 		if ok {
 			if len(diskName) == 0 {
-				err := fmt.Errorf(errorMsg, err)
+				err := fmt.Errorf(errorMsg, "no disk name")
 				ui.Error(err.Error())
 				return
 			}
 
-			if err := retry.ExecuteOperation(func() error {
-				return vmdisk.NewClient(client).DeleteDisk(diskName, true)
-			}, retry.ConstantBackoffRule("busy", func(err management.AzureError) bool {
-				return strings.Contains(err.Message, "is currently performing an operation on deployment") ||
-					strings.Contains(err.Message, "is currently in use by virtual machine")
-			}, 30*time.Second, 10)); err != nil {
+			if err := deleteDisk(client, diskName, true); err != nil {
 				err := fmt.Errorf(errorMsg, err)
 				ui.Error(err.Error())
 				return
@@ -0,0 +1,56 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+)
+
+// deleteClient records DELETE requests.
+type deleteClient struct {
+	management.Client
+	urls []string
+}
+
+func (c *deleteClient) SendAzureDeleteRequest(url string) (management.OperationID, error) {
+	c.urls = append(c.urls, url)
+	return "", nil
+}
+
+func TestStepCreateImage_Cleanup(t *testing.T) {
+	for _, tc := range []struct {
+		vmExists int
+		expected []string
+	}{
+		// the disk of the captured VM is removed after a successful build
+		{0, []string{"services/disks/PkrSrvx-PkrVMx-0-201601020304050607?comp=media"}},
+		{1, nil},
+	} {
+		client := &deleteClient{}
+		state := new(multistep.BasicStateBag)
+		state.Put(constants.RequestManager, client)
+		state.Put(constants.Ui, &packer.BasicUi{Writer: ioutil.Discard, ErrorWriter: ioutil.Discard})
+		state.Put(constants.VmExists, tc.vmExists)
+		state.Put(constants.DiskExists, 1)
+		state.Put(constants.HardDiskName, "PkrSrvx-PkrVMx-0-201601020304050607")
+
+		new(StepCreateImage).Cleanup(state)
+
+		if !reflect.DeepEqual(client.urls, tc.expected) {
+			t.Errorf("expected requests %q, got %q", tc.expected, client.urls)
+		}
+		if exists := state.Get(constants.DiskExists).(int); (exists == 0) != (tc.vmExists == 0) {
+			t.Errorf("unexpected DiskExists %d", exists)
+		}
+	}
+}
@@ -4,7 +4,6 @@
 package azure
 
 import (
-	"encoding/base64"
 	"fmt"
 
 	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
@@ -19,23 +18,22 @@ import (
 
 type StepCreateService struct {
 	Location       string
+	AffinityGroup  string
 	TmpServiceName string
 }
 
 func (s *StepCreateService) Run(state multistep.StateBag) multistep.StepAction {
 	client := state.Get(constants.RequestManager).(management.Client)
-	hsc := hostedservice.NewClient(client)
 	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
 
 	errorMsg := "Error creating temporary Azure service: %s"
 
 	ui.Say("Creating temporary Azure service...")
 
-	if err := hsc.CreateHostedService(hostedservice.CreateHostedServiceParameters{
-		ServiceName: s.TmpServiceName,
-		Location:    s.Location,
-		Label:       base64.StdEncoding.EncodeToString([]byte(s.TmpServiceName)),
-	}); err != nil {
+	journalResource(state, KindHostedService, s.TmpServiceName)
+
+	if err := createHostedService(client, s.TmpServiceName, s.Location, s.AffinityGroup, config.metadata); err != nil {
 		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
 		ui.Error(err.Error())
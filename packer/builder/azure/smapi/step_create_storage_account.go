@@ -0,0 +1,149 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/management/storageservice"
+)
+
+// StepCreateStorageAccount creates a dedicated storage account for the build
+// when storage_account is set to "auto".
+type StepCreateStorageAccount struct {
+	StorageAccount  string
+	Location        string
+	AffinityGroup   string
+	RemoveOnFailure bool
+
+	flagAccountCreated bool
+}
+
+func (s *StepCreateStorageAccount) Run(state multistep.StateBag) multistep.StepAction {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ssc := storageservice.NewClient(client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+
+	errorMsg := "Error creating storage account: %s"
+
+	ui.Say(fmt.Sprintf("Creating storage account %q in location %q...", s.StorageAccount, s.Location))
+
+	availability, err := ssc.CheckStorageAccountNameAvailability(s.StorageAccount)
+	if err == nil && !availability.Result {
+		err = fmt.Errorf("name %q is not available: %s", s.StorageAccount, availability.Reason)
+	}
+	if err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// the account is placed like the temporary service
+	location := s.Location
+	if s.AffinityGroup != "" {
+		location = ""
+	}
+
+	if s.RemoveOnFailure {
+		journalResource(state, KindStorageAccount, s.StorageAccount)
+	}
+	if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return ssc.CreateStorageService(storageservice.StorageAccountCreateParameters{
+			ServiceName:   s.StorageAccount,
+			Label:         base64.StdEncoding.EncodeToString([]byte(s.StorageAccount)),
+			Description:   "Storage account created by packer",
+			Location:      location,
+			AffinityGroup: s.AffinityGroup,
+			AccountType:   storageservice.AccountTypeStandardLRS,
+		})
+	}); err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	s.flagAccountCreated = true
+
+	ui.Message("Waiting for storage account to be created...")
+	if err := waitForStorageAccount(ssc, s.StorageAccount, state); err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+// Resume marks the storage account of the resumed build as created.
+func (s *StepCreateStorageAccount) Resume(state multistep.StateBag) {
+	s.flagAccountCreated = true
+}
+
+func (s *StepCreateStorageAccount) Cleanup(state multistep.StateBag) {
+	if !s.flagAccountCreated {
+		return
+	}
+
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+
+	if !s.RemoveOnFailure || !common.IsStateFailed(state) {
+		ui.Message(fmt.Sprintf("Keeping storage account %q", s.StorageAccount))
+		return
+	}
+
+	ui.Say(fmt.Sprintf("Removing storage account %q...", s.StorageAccount))
+
+	if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return storageservice.NewClient(client).DeleteStorageService(s.StorageAccount)
+	}); err != nil {
+		ui.Error(fmt.Sprintf("Error removing storage account: %s", err))
+		return
+	}
+
+	s.flagAccountCreated = false
+}
+
+func waitForStorageAccount(ssc storageservice.StorageServiceClient, name string, state multistep.StateBag) error {
+	const status = "Created"
+
+	var count uint = 60
+	var duration time.Duration = 10
+	sleepTime := time.Second * duration
+	total := count * uint(duration)
+
+	for count > 0 {
+		if common.IsStateCancelled(state) {
+			return fmt.Errorf("cancelled while waiting for storage account %q", name)
+		}
+
+		sa, err := ssc.GetStorageService(name)
+		if err != nil {
+			return err
+		}
+		if sa.StorageServiceProperties.Status == status {
+			return nil
+		}
+
+		log.Printf("Storage account %q is %q, waiting for another %v seconds...", name, sa.StorageServiceProperties.Status, uint(duration))
+		time.Sleep(sleepTime)
+		count--
+	}
+
+	return fmt.Errorf("storage account %q did not reach status %q in time (%d seconds)", name, status, total)
+}
@@ -33,9 +33,11 @@ func (*StepCreateVm) Run(state multistep.StateBag) multistep.StepAction {
 	if config.VNet != "" && config.Subnet != "" {
 		options.VirtualNetworkName = config.VNet
 	}
+	options.ReservedIPName = config.ReservedIPName
 
+	journalResource(state, KindDeployment, fmt.Sprintf("%s/%s", config.tmpServiceName, role.RoleName))
 	if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
-		return vm.NewClient(client).CreateDeployment(*role, config.tmpServiceName, options)
+		return createDeployment(client, *role, config.tmpServiceName, options)
 	}); err != nil {
 		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
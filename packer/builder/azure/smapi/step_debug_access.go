@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+)
+
+// StepDebugAccess writes an RDP connection file and prints the credentials
+// and the PowerShell endpoint of the temporary Windows VM, so that it can be
+// accessed while a -debug build is paused.
+type StepDebugAccess struct {
+	TmpServiceName string
+	TmpVmName      string
+	RdpFilePath    string
+}
+
+func (s *StepDebugAccess) Run(state multistep.StateBag) multistep.StepAction {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
+
+	errorMsg := "Error preparing debug access: %s"
+
+	deployment, err := vm.NewClient(client).GetDeployment(s.TmpServiceName, s.TmpVmName)
+	if err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	host := fmt.Sprintf("%s.cloudapp.net", s.TmpServiceName)
+	var rdpPort, powerShellPort int
+	if len(deployment.RoleInstanceList) > 0 {
+		for _, endpoint := range deployment.RoleInstanceList[0].InstanceEndpoints {
+			switch endpoint.Name {
+			case "RDP":
+				rdpPort = endpoint.PublicPort
+			case "PowerShell":
+				powerShellPort = endpoint.PublicPort
+			}
+		}
+	}
+
+	ui.Say("Debug access to the temporary Azure VM:")
+	ui.Message(fmt.Sprintf("Username: %s", config.UserName))
+	ui.Message(fmt.Sprintf("Password: %s", state.Get("password").(string)))
+
+	if powerShellPort != 0 {
+		ui.Message(fmt.Sprintf("PowerShell: https://%s:%d/wsman", host, powerShellPort))
+	}
+
+	if rdpPort == 0 {
+		ui.Message("The VM has no public RDP endpoint")
+		return multistep.ActionContinue
+	}
+
+	ui.Message(fmt.Sprintf("Saving RDP connection file: %s", s.RdpFilePath))
+	if err := ioutil.WriteFile(s.RdpFilePath, []byte(rdpFile(host, rdpPort, config.UserName)), 0600); err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepDebugAccess) Cleanup(state multistep.StateBag) {
+	// do nothing
+}
+
+func rdpFile(host string, port int, userName string) string {
+	return fmt.Sprintf("full address:s:%s:%d\r\nusername:s:%s\r\nprompt for credentials:i:1\r\n", host, port, userName)
+}
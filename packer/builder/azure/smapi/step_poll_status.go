@@ -39,57 +39,9 @@ func (s *StepPollStatus) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
-	var count uint = 60
-	var duration time.Duration = 40
-	sleepTime := time.Second * duration
-	total := count * uint(duration)
-
-	var deployment vm.DeploymentResponse
-
-	for count > 0 {
-		var err error // deployment needs to be accessed outside of this loop, can't use :=
-		deployment, err = vmc.GetDeployment(s.TmpServiceName, s.TmpVmName)
-		if err != nil {
-			err := fmt.Errorf(errorMsg, err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return multistep.ActionHalt
-		}
-
-		if len(deployment.RoleInstanceList) > 0 {
-			powerState := deployment.RoleInstanceList[0].PowerState
-			instanceStatus := deployment.RoleInstanceList[0].InstanceStatus
-
-			if powerState == vm.PowerStateStarted && instanceStatus == vm.InstanceStatusReadyRole {
-				break
-			}
-
-			if instanceStatus == vm.InstanceStatusFailedStartingRole ||
-				instanceStatus == vm.InstanceStatusFailedStartingVM ||
-				instanceStatus == vm.InstanceStatusUnresponsiveRole {
-				err := fmt.Errorf(errorMsg, "deployment.RoleInstanceList[0].instanceStatus is "+instanceStatus)
-				state.Put("error", err)
-				ui.Error(err.Error())
-				return multistep.ActionHalt
-			}
-			if powerState == vm.PowerStateStopping ||
-				powerState == vm.PowerStateStopped ||
-				powerState == vm.PowerStateUnknown {
-				err := fmt.Errorf(errorMsg, "deployment.RoleInstanceList[0].PowerState is "+powerState)
-				state.Put("error", err)
-				ui.Error(err.Error())
-				return multistep.ActionHalt
-			}
-		}
-
-		// powerState_Starting or deployment.RoleInstanceList[0] == 0
-		log.Println(fmt.Sprintf("Waiting for another %v seconds...", uint(duration)))
-		time.Sleep(sleepTime)
-		count--
-	}
-
-	if count == 0 {
-		err := fmt.Errorf(errorMsg, fmt.Sprintf("time is up (%d seconds)", total))
+	deployment, err := waitForReadyRole(vmc, s.TmpServiceName, s.TmpVmName)
+	if err != nil {
+		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
@@ -126,6 +78,13 @@ func (s *StepPollStatus) Run(state multistep.StateBag) multistep.StepAction {
 	ui.Message("VM DiskName: " + diskName)
 	state.Put(constants.HardDiskName, diskName)
 
+	state.Put(constants.DataDisks, roleList[0].DataVirtualHardDisks)
+
+	journalResource(state, KindDisk, diskName)
+	for _, d := range roleList[0].DataVirtualHardDisks {
+		journalResource(state, KindDisk, d.DiskName)
+	}
+
 	mediaLink := roleList[0].OSVirtualHardDisk.MediaLink
 	ui.Message("VM MediaLink: " + mediaLink)
 	state.Put(constants.MediaLink, mediaLink)
@@ -136,3 +95,46 @@ func (s *StepPollStatus) Run(state multistep.StateBag) multistep.StepAction {
 func (s *StepPollStatus) Cleanup(state multistep.StateBag) {
 	// nothing to do
 }
+
+// waitForReadyRole polls the deployment of a VM until its role instance is
+// started and ready.
+func waitForReadyRole(vmc vm.VirtualMachineClient, serviceName, vmName string) (vm.DeploymentResponse, error) {
+	var count uint = 60
+	var duration time.Duration = 40
+	sleepTime := time.Second * duration
+	total := count * uint(duration)
+
+	for count > 0 {
+		deployment, err := vmc.GetDeployment(serviceName, vmName)
+		if err != nil {
+			return deployment, err
+		}
+
+		if len(deployment.RoleInstanceList) > 0 {
+			powerState := deployment.RoleInstanceList[0].PowerState
+			instanceStatus := deployment.RoleInstanceList[0].InstanceStatus
+
+			if powerState == vm.PowerStateStarted && instanceStatus == vm.InstanceStatusReadyRole {
+				return deployment, nil
+			}
+
+			if instanceStatus == vm.InstanceStatusFailedStartingRole ||
+				instanceStatus == vm.InstanceStatusFailedStartingVM ||
+				instanceStatus == vm.InstanceStatusUnresponsiveRole {
+				return deployment, fmt.Errorf("deployment.RoleInstanceList[0].instanceStatus is %s", instanceStatus)
+			}
+			if powerState == vm.PowerStateStopping ||
+				powerState == vm.PowerStateStopped ||
+				powerState == vm.PowerStateUnknown {
+				return deployment, fmt.Errorf("deployment.RoleInstanceList[0].PowerState is %s", powerState)
+			}
+		}
+
+		// powerState_Starting or deployment.RoleInstanceList[0] == 0
+		log.Println(fmt.Sprintf("Waiting for another %v seconds...", uint(duration)))
+		time.Sleep(sleepTime)
+		count--
+	}
+
+	return vm.DeploymentResponse{}, fmt.Errorf("time is up (%d seconds)", total)
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+)
+
+// StepSaveDiagnostics does nothing when run. On cleanup of a failed build it
+// saves the state of the temporary deployment to a local JSON file before
+// the service is removed.
+type StepSaveDiagnostics struct {
+	TmpServiceName string
+	TmpVmName      string
+	Path           string
+}
+
+func (s *StepSaveDiagnostics) Run(state multistep.StateBag) multistep.StepAction {
+	return multistep.ActionContinue
+}
+
+func (s *StepSaveDiagnostics) Cleanup(state multistep.StateBag) {
+	buildErr, failed := state.GetOk("error")
+	if !failed {
+		return
+	}
+
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+
+	ui.Say("Saving diagnostics of the temporary Azure VM...")
+
+	bundle := diagnosticsBundle{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		ServiceName: s.TmpServiceName,
+		VmName:      s.TmpVmName,
+		Error:       fmt.Sprint(buildErr),
+	}
+	if role, ok := state.GetOk("role"); ok {
+		bundle.Role = scrubRole(*role.(*vm.Role))
+	}
+	if err := bundle.collect(client); err != nil {
+		ui.Error(fmt.Sprintf("Error collecting diagnostics: %s", err))
+		bundle.DiagnosticsError = err.Error()
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(s.Path, data, 0600)
+	}
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error saving diagnostics: %s", err))
+		return
+	}
+	ui.Message(fmt.Sprintf("Diagnostics saved to %s", s.Path))
+}
+
+type diagnosticsBundle struct {
+	Time        string
+	ServiceName string
+	VmName      string
+	Error       string
+
+	// Deployment is the GetDeployment response, RoleInstances adds the guest
+	// agent status that the SDK does not decode.
+	Deployment    *vm.DeploymentResponse `json:",omitempty"`
+	RoleInstances []roleInstanceStatus   `json:",omitempty"`
+
+	// Role is the role configuration that was sent, without passwords.
+	Role *vm.Role `json:",omitempty"`
+
+	DiagnosticsError string `json:",omitempty"`
+}
+
+type roleInstanceStatus struct {
+	RoleName                    string
+	InstanceName                string
+	InstanceStatus              vm.InstanceStatus
+	InstanceStateDetails        string
+	InstanceErrorCode           string
+	PowerState                  vm.PowerState
+	GuestAgentStatus            guestAgentStatus
+	ResourceExtensionStatusList []vm.ResourceExtensionStatus
+}
+
+type guestAgentStatus struct {
+	ProtocolVersion   string
+	Timestamp         string
+	GuestAgentVersion string
+	Status            string
+	Code              string
+	Message           struct {
+		MessageResourceId string
+		ParamList         []string `xml:">Param"`
+	}
+	FormattedMessage struct {
+		Language string
+		Message  string
+	}
+}
+
+// collect reads the deployment of the temporary VM.
+func (b *diagnosticsBundle) collect(client management.Client) error {
+	response, err := client.SendAzureGetRequest(fmt.Sprintf("services/hostedservices/%s/deployments/%s", b.ServiceName, b.VmName))
+	if err != nil {
+		return err
+	}
+
+	var deployment vm.DeploymentResponse
+	if err := xml.Unmarshal(response, &deployment); err != nil {
+		return err
+	}
+	b.Deployment = &deployment
+
+	var instances struct {
+		RoleInstanceList []struct {
+			InstanceName     string
+			GuestAgentStatus guestAgentStatus
+		} `xml:"RoleInstanceList>RoleInstance"`
+	}
+	if err := xml.Unmarshal(response, &instances); err != nil {
+		return err
+	}
+
+	for _, ri := range deployment.RoleInstanceList {
+		status := roleInstanceStatus{
+			RoleName:                    ri.RoleName,
+			InstanceName:                ri.InstanceName,
+			InstanceStatus:              ri.InstanceStatus,
+			InstanceStateDetails:        ri.InstanceStateDetails,
+			InstanceErrorCode:           ri.InstanceErrorCode,
+			PowerState:                  ri.PowerState,
+			ResourceExtensionStatusList: ri.ResourceExtensionStatusList,
+		}
+		for _, i := range instances.RoleInstanceList {
+			if i.InstanceName == ri.InstanceName {
+				status.GuestAgentStatus = i.GuestAgentStatus
+			}
+		}
+		b.RoleInstances = append(b.RoleInstances, status)
+	}
+	return nil
+}
+
+// scrubRole returns a copy of role without the passwords.
+func scrubRole(role vm.Role) *vm.Role {
+	role.ConfigurationSets = append([]vm.ConfigurationSet(nil), role.ConfigurationSets...)
+	for i := range role.ConfigurationSets {
+		cs := &role.ConfigurationSets[i]
+		if cs.AdminPassword != "" {
+			cs.AdminPassword = "<sensitive>"
+		}
+		if cs.UserPassword != "" {
+			cs.UserPassword = "<sensitive>"
+		}
+		// custom data often holds secrets and an AutoLogon setting of the
+		// unattend content holds the admin password
+		if cs.CustomData != "" {
+			cs.CustomData = "<sensitive>"
+		}
+		if cs.AdditionalUnattendContent != "" {
+			cs.AdditionalUnattendContent = "<sensitive>"
+		}
+		if cs.DomainJoin != nil {
+			domainJoin := *cs.DomainJoin
+			domainJoin.Credentials.Password = "<sensitive>"
+			cs.DomainJoin = &domainJoin
+		}
+	}
+	return &role
+}
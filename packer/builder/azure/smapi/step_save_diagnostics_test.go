@@ -0,0 +1,105 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+	"github.com/Azure/azure-sdk-for-go/management/vmutils"
+)
+
+// getClient answers GET requests with a fixed response, all other calls
+// panic.
+type getClient struct {
+	management.Client
+	url      string
+	response string
+}
+
+func (c *getClient) SendAzureGetRequest(url string) ([]byte, error) {
+	c.url = url
+	return []byte(c.response), nil
+}
+
+const testDeploymentResponse = `<Deployment xmlns="http://schemas.microsoft.com/windowsazure">
+  <Name>PkrVMtest</Name>
+  <RoleInstanceList>
+    <RoleInstance>
+      <RoleName>PkrVMtest</RoleName>
+      <InstanceName>PkrVMtest</InstanceName>
+      <InstanceStatus>ProvisioningFailed</InstanceStatus>
+      <InstanceErrorCode>ProvisioningFailed</InstanceErrorCode>
+      <PowerState>Started</PowerState>
+      <GuestAgentStatus>
+        <ProtocolVersion>1.0</ProtocolVersion>
+        <GuestAgentVersion>WALinuxAgent-2.0.16</GuestAgentVersion>
+        <Status>NotReady</Status>
+        <FormattedMessage>
+          <Language>en-US</Language>
+          <Message>Provisioning failed</Message>
+        </FormattedMessage>
+      </GuestAgentStatus>
+      <ResourceExtensionStatusList>
+        <ResourceExtensionStatus>
+          <HandlerName>Microsoft.Compute.CustomScriptExtension</HandlerName>
+          <Status>Unresponsive</Status>
+        </ResourceExtensionStatus>
+      </ResourceExtensionStatusList>
+    </RoleInstance>
+  </RoleInstanceList>
+</Deployment>`
+
+func TestDiagnosticsBundle_Collect(t *testing.T) {
+	client := &getClient{response: testDeploymentResponse}
+	bundle := diagnosticsBundle{ServiceName: "PkrSrvtest", VmName: "PkrVMtest"}
+
+	if err := bundle.collect(client); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "services/hostedservices/PkrSrvtest/deployments/PkrVMtest"; client.url != expected {
+		t.Errorf("expected request to %q, got %q", expected, client.url)
+	}
+	if bundle.Deployment == nil || bundle.Deployment.Name != "PkrVMtest" {
+		t.Fatalf("unexpected deployment %+v", bundle.Deployment)
+	}
+	if len(bundle.RoleInstances) != 1 {
+		t.Fatalf("expected one role instance, got %d", len(bundle.RoleInstances))
+	}
+
+	ri := bundle.RoleInstances[0]
+	if ri.InstanceStatus != "ProvisioningFailed" || ri.InstanceErrorCode != "ProvisioningFailed" {
+		t.Errorf("unexpected role instance status %+v", ri)
+	}
+	if ri.GuestAgentStatus.Status != "NotReady" || ri.GuestAgentStatus.FormattedMessage.Message != "Provisioning failed" {
+		t.Errorf("unexpected guest agent status %+v", ri.GuestAgentStatus)
+	}
+	if len(ri.ResourceExtensionStatusList) != 1 || ri.ResourceExtensionStatusList[0].Status != "Unresponsive" {
+		t.Errorf("unexpected extension status %+v", ri.ResourceExtensionStatusList)
+	}
+}
+
+func TestScrubRole(t *testing.T) {
+	role := vmutils.NewVMConfiguration("vm", "Small")
+	vmutils.ConfigureForWindows(&role, "vm", "packer", "P@ssw0rd", true, "")
+	role.ConfigurationSets[0].CustomData = "c2VjcmV0"
+	role.ConfigurationSets[0].AdditionalUnattendContent = "PEF1dG9Mb2dvbj4="
+
+	scrubbed := scrubRole(role)
+	cs := scrubbed.ConfigurationSets[0]
+	if cs.AdminPassword != "<sensitive>" {
+		t.Errorf("password was not scrubbed")
+	}
+	if cs.CustomData != "<sensitive>" || cs.AdditionalUnattendContent != "<sensitive>" {
+		t.Errorf("custom data or unattend content was not scrubbed: %+v", cs)
+	}
+	if role.ConfigurationSets[0].AdminPassword != "P@ssw0rd" || role.ConfigurationSets[0].CustomData != "c2VjcmV0" {
+		t.Errorf("role was modified")
+	}
+	if scrubbed.ConfigurationSets[0].ConfigurationSetType != vm.ConfigurationSetTypeWindowsProvisioning {
+		t.Errorf("unexpected configuration set %+v", scrubbed.ConfigurationSets[0])
+	}
+}
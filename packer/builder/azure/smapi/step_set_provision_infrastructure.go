@@ -40,8 +40,10 @@ func (s *StepSetProvisionInfrastructure) Run(state multistep.StateBag) multistep
 	//create temporary container
 	s.flagTempContainerCreated = false
 
+	// the container exists already if the build is resumed
 	ui.Message("Creating Azure temporary container...")
-	err := config.storageClient.GetBlobService().CreateContainer(s.TempContainerName, storage.ContainerAccessTypePrivate)
+	journalResource(state, KindContainer, fmt.Sprintf("%s/%s", s.StorageAccountName, s.TempContainerName))
+	_, err := config.storageClient.GetBlobService().CreateContainerIfNotExists(s.TempContainerName, storage.ContainerAccessTypePrivate)
 	if err != nil {
 		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
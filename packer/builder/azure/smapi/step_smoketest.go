@@ -0,0 +1,239 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/lin"
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+	"github.com/Azure/packer-azure/packer/communicator/azureVmCustomScriptExtension"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/helper/communicator"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/management/hostedservice"
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+	vmimage "github.com/Azure/azure-sdk-for-go/management/virtualmachineimage"
+	"github.com/Azure/azure-sdk-for-go/management/vmutils"
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// StepSmokeTest deploys a VM from the captured image into a temporary
+// service, waits until it is ready and runs the smoke test commands on it.
+// Everything is removed afterwards, a failing smoke test fails the build.
+type StepSmokeTest struct {
+	ServiceName          string
+	VmName               string
+	ContainerName        string
+	UserImageName        string
+	Commands             []string
+	RemoveImageOnFailure bool
+
+	flagServiceCreated   bool
+	flagContainerCreated bool
+}
+
+func (s *StepSmokeTest) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get(constants.Ui).(packer.Ui)
+
+	ui.Say("Smoke testing the captured image...")
+
+	if err := s.run(state); err != nil {
+		err := fmt.Errorf("Smoke test of image %q failed: %s", s.UserImageName, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		s.removeImage(state)
+		return multistep.ActionHalt
+	}
+
+	ui.Message("Smoke test passed")
+	return multistep.ActionContinue
+}
+
+func (s *StepSmokeTest) run(state multistep.StateBag) error {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
+
+	role := vmutils.NewVMConfiguration(s.VmName, config.InstanceSize)
+	role.VMImageName = s.UserImageName
+
+	if config.OSType == constants.Target_Linux {
+		vmutils.ConfigureForLinux(&role, s.VmName, config.UserName, config.Comm.SSHPassword, state.Get(constants.Thumbprint).(string))
+		for i := range role.ConfigurationSets {
+			if role.ConfigurationSets[i].ConfigurationSetType == vm.ConfigurationSetTypeLinuxProvisioning {
+				role.ConfigurationSets[i].DisableSSHPasswordAuthentication = "false"
+			}
+		}
+		vmutils.ConfigureWithPublicSSH(&role)
+	} else {
+		vmutils.ConfigureForWindows(&role, s.VmName, config.UserName, state.Get("password").(string), true, "")
+		vmutils.ConfigureWithPublicPowerShell(&role)
+	}
+
+	options := vm.CreateDeploymentOptions{}
+	if config.VNet != "" && config.Subnet != "" {
+		vmutils.ConfigureWithSubnet(&role, config.Subnet)
+		options.VirtualNetworkName = config.VNet
+	}
+
+	ui.Message(fmt.Sprintf("Creating smoke test service %q...", s.ServiceName))
+	journalResource(state, KindHostedService, s.ServiceName)
+	if err := createHostedService(client, s.ServiceName, config.Location, config.AffinityGroup, config.metadata); err != nil {
+		return fmt.Errorf("error creating service: %v", err)
+	}
+	s.flagServiceCreated = true
+
+	if config.OSType == constants.Target_Linux {
+		certData := []byte(state.Get(constants.Certificate).(string))
+		if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+			return hostedservice.NewClient(client).AddCertificate(s.ServiceName, certData, hostedservice.CertificateFormatPfx, "")
+		}); err != nil {
+			return fmt.Errorf("error uploading certificate: %v", err)
+		}
+	}
+
+	ui.Message(fmt.Sprintf("Creating smoke test VM %q...", s.VmName))
+	if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return vm.NewClient(client).CreateDeployment(role, s.ServiceName, options)
+	}); err != nil {
+		return fmt.Errorf("error creating VM: %v", err)
+	}
+
+	ui.Message("Waiting for smoke test VM to be ready...")
+	deployment, err := waitForReadyRole(vm.NewClient(client), s.ServiceName, s.VmName)
+	if err != nil {
+		return fmt.Errorf("VM did not become ready: %v", err)
+	}
+
+	if len(s.Commands) == 0 {
+		return nil
+	}
+
+	comm, cleanup, err := s.connect(state, deployment)
+	if cleanup != nil {
+		defer cleanup()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, command := range s.Commands {
+		ui.Message(fmt.Sprintf("Running smoke test command: %s", command))
+		cmd := &packer.RemoteCmd{Command: command}
+		if err := cmd.StartWithUi(comm, ui); err != nil {
+			return fmt.Errorf("error running %q: %v", command, err)
+		}
+		if cmd.ExitStatus != 0 {
+			return fmt.Errorf("command %q exited with status %d", command, cmd.ExitStatus)
+		}
+	}
+	return nil
+}
+
+// connect returns a communicator for the smoke test VM, SSH on Linux and the
+// custom script extension on Windows.
+func (s *StepSmokeTest) connect(state multistep.StateBag, deployment vm.DeploymentResponse) (packer.Communicator, func(), error) {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
+
+	if config.OSType == constants.Target_Linux {
+		endpoints := deployment.RoleInstanceList[0].InstanceEndpoints
+		if len(endpoints) == 0 {
+			return nil, nil, fmt.Errorf("smoke test VM has no endpoints")
+		}
+
+		connectState := new(multistep.BasicStateBag)
+		connectState.Put(constants.Ui, ui)
+		connectState.Put(constants.SSHHost, endpoints[0].Vip)
+		connectState.Put(constants.PrivateKey, state.Get(constants.PrivateKey))
+
+		step := &communicator.StepConnectSSH{
+			Config:    &config.Comm,
+			Host:      lin.SSHHost,
+			SSHConfig: lin.SSHConfig(config.UserName, config.Comm.SSHPassword),
+		}
+		cleanup := func() { step.Cleanup(connectState) }
+		if step.Run(connectState) != multistep.ActionContinue {
+			if err, ok := connectState.GetOk("error"); ok {
+				return nil, cleanup, fmt.Errorf("error connecting over SSH: %v", err)
+			}
+			return nil, cleanup, fmt.Errorf("error connecting over SSH")
+		}
+		return connectState.Get("communicator").(packer.Communicator), cleanup, nil
+	}
+
+	blobs := config.storageClient.GetBlobService()
+	journalResource(state, KindContainer, fmt.Sprintf("%s/%s", config.StorageAccount, s.ContainerName))
+	if err := blobs.CreateContainer(s.ContainerName, storage.ContainerAccessTypePrivate); err != nil {
+		return nil, nil, fmt.Errorf("error creating container %q: %v", s.ContainerName, err)
+	}
+	s.flagContainerCreated = true
+
+	comm := azureVmCustomScriptExtension.New(
+		azureVmCustomScriptExtension.Config{
+			ServiceName:               s.ServiceName,
+			VmName:                    s.VmName,
+			StorageAccountName:        config.StorageAccount,
+			StorageAccountKey:         config.storageAccountKey,
+			BlobClient:                blobs,
+			ContainerName:             s.ContainerName,
+			Ui:                        ui,
+			ManagementClient:          client,
+			ProvisionTimeoutInMinutes: config.ProvisionTimeoutInMinutes,
+		})
+	return comm, nil, nil
+}
+
+// removeImage removes the captured image and its VHDs if the smoke test
+// failed and this was requested.
+func (s *StepSmokeTest) removeImage(state multistep.StateBag) {
+	if !s.RemoveImageOnFailure {
+		return
+	}
+
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+
+	// the smoke test VM needs to be gone before the image can be removed
+	s.Cleanup(state)
+
+	ui.Say(fmt.Sprintf("Removing image %q that failed the smoke test...", s.UserImageName))
+	if err := retry.ExecuteOperation(func() error {
+		return vmimage.NewClient(client).DeleteVirtualMachineImage(s.UserImageName, true)
+	}); err != nil {
+		ui.Error(fmt.Sprintf("Error removing image: %s", err))
+	}
+}
+
+func (s *StepSmokeTest) Cleanup(state multistep.StateBag) {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
+
+	if s.flagServiceCreated {
+		ui.Say("Removing smoke test service, VM and disks...")
+		if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+			return hostedservice.NewClient(client).DeleteHostedService(s.ServiceName, true)
+		}); err != nil {
+			ui.Error(fmt.Sprintf("Error removing smoke test service: %s", err))
+		} else {
+			s.flagServiceCreated = false
+		}
+	}
+
+	if s.flagContainerCreated {
+		ui.Message("Removing smoke test container...")
+		if err := config.storageClient.GetBlobService().DeleteContainer(s.ContainerName); err != nil {
+			ui.Error(fmt.Sprintf("Error removing smoke test container: %s", err))
+		} else {
+			s.flagContainerCreated = false
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/vhd"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+)
+
+// StepUploadSourceVhd uploads a local VHD to the storage account and
+// registers it as a temporary OS image that the VM is deployed from. Images
+// that Azure does not accept are converted to a fixed VHD first.
+type StepUploadSourceVhd struct {
+	SourceVhdPath string
+	OSImageName   string
+	OSType        string
+
+	flagBlobUploaded    bool
+	flagImageRegistered bool
+}
+
+func (s *StepUploadSourceVhd) Run(state multistep.StateBag) multistep.StepAction {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
+
+	errorMsg := "Error uploading source VHD: %s"
+
+	sourcePath, err := s.prepareSourceVhd(ui)
+	if err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if sourcePath != s.SourceVhdPath {
+		defer os.Remove(sourcePath)
+	}
+
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	blobName := s.OSImageName + ".vhd"
+	mediaLink := config.storageClient.GetBlobService().GetBlobURL(config.StorageContainer, blobName)
+
+	ui.Say(fmt.Sprintf("Uploading %s (%.1f GiB) to %s...", sourcePath, float64(fi.Size())/1024/1024/1024, mediaLink))
+
+	journalResource(state, KindBlob, fmt.Sprintf("%s/%s/%s", config.StorageAccount, config.StorageContainer, blobName))
+	s.flagBlobUploaded = true
+	lastPercent := int64(-1)
+	if err := uploadPageBlob(config.storageClient.GetBlobService(), config.StorageContainer, blobName, f, fi.Size(), func(done int64) error {
+		if common.IsStateCancelled(state) {
+			return fmt.Errorf("upload cancelled")
+		}
+		if percent := done * 100 / fi.Size(); percent/10 != lastPercent/10 {
+			lastPercent = percent
+			ui.Message(fmt.Sprintf("Upload progress: %d%%", percent))
+		}
+		return nil
+	}); err != nil {
+		err := fmt.Errorf(errorMsg, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Registering temporary OS image %q...", s.OSImageName))
+	journalResource(state, KindOSImage, s.OSImageName)
+	if err := RegisterOSImage(client, OSImageParameters{
+		Label:     s.OSImageName,
+		MediaLink: mediaLink,
+		Name:      s.OSImageName,
+		OS:        s.OSType,
+	}); err != nil {
+		err := fmt.Errorf("Error registering temporary OS image: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	s.flagImageRegistered = true
+	s.flagBlobUploaded = false // the blob is removed with the OS image
+
+	return multistep.ActionContinue
+}
+
+// prepareSourceVhd returns the path of a fixed VHD that Azure accepts. Raw
+// disk images, dynamic VHDs and VHDs with a size that is not a whole number
+// of MiB are converted to a temporary file.
+func (s *StepUploadSourceVhd) prepareSourceVhd(ui packer.Ui) (string, error) {
+	ui.Say(fmt.Sprintf("Checking source VHD %s...", s.SourceVhdPath))
+
+	format, footer, err := vhd.Inspect(s.SourceVhdPath)
+	if err != nil {
+		return "", err
+	}
+	if format == vhd.FormatFixed {
+		err := footer.Validate()
+		if err == nil {
+			return s.SourceVhdPath, nil
+		}
+		ui.Message(fmt.Sprintf("Source VHD needs to be converted: %s", err))
+	}
+
+	tmp, err := ioutil.TempFile("", "packer-source-vhd")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	ui.Message(fmt.Sprintf("Converting source image to a fixed VHD at %s...", tmp.Name()))
+	if err := vhd.ConvertToFixed(s.SourceVhdPath, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("error converting %s to a fixed VHD: %v", s.SourceVhdPath, err)
+	}
+	return tmp.Name(), nil
+}
+
+// Resume marks the OS image of the resumed build as registered.
+func (s *StepUploadSourceVhd) Resume(state multistep.StateBag) {
+	s.flagImageRegistered = true
+}
+
+func (s *StepUploadSourceVhd) Cleanup(state multistep.StateBag) {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
+
+	if s.flagImageRegistered {
+		ui.Say(fmt.Sprintf("Removing temporary OS image %q...", s.OSImageName))
+
+		if err := DeleteOSImage(client, s.OSImageName, true); err != nil {
+			ui.Error(fmt.Sprintf("Error removing temporary OS image: %s", err))
+			return
+		}
+		s.flagImageRegistered = false
+	}
+
+	if s.flagBlobUploaded {
+		ui.Message("Removing uploaded source VHD...")
+
+		if _, err := config.storageClient.GetBlobService().DeleteBlobIfExists(config.StorageContainer, s.OSImageName+".vhd", nil); err != nil {
+			ui.Error(fmt.Sprintf("Error removing uploaded source VHD: %s", err))
+			return
+		}
+		s.flagBlobUploaded = false
+	}
+}
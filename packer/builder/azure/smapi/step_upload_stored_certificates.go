@@ -0,0 +1,51 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/management/hostedservice"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// StepUploadStoredCertificates uploads the stored_certificates to the
+// temporary service so that they can be installed on the VM.
+type StepUploadStoredCertificates struct {
+	TmpServiceName string
+	Certificates   []StoredCertificate
+}
+
+func (s *StepUploadStoredCertificates) Run(state multistep.StateBag) multistep.StepAction {
+	client := state.Get(constants.RequestManager).(management.Client)
+	ui := state.Get("ui").(packer.Ui)
+	errorMsg := "Error Uploading Certificate %s: %s"
+
+	ui.Say("Uploading Stored Certificates...")
+
+	for _, c := range s.Certificates {
+		ui.Message(fmt.Sprintf("Uploading %s (%s) for store %s/%s", c.Path, c.thumbprint, c.StoreLocation, c.StoreName))
+
+		if err := retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+			return hostedservice.NewClient(client).AddCertificate(s.TmpServiceName, c.data, hostedservice.CertificateFormatPfx, c.Password)
+		}); err != nil {
+			err := fmt.Errorf(errorMsg, c.Path, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepUploadStoredCertificates) Cleanup(state multistep.StateBag) {
+	// do nothing, the certificates are removed with the service
+}
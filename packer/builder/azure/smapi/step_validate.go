@@ -3,12 +3,17 @@ package azure
 import (
 	"encoding/xml"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/Azure/packer-azure/packer/builder/azure/common"
 	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/vhd"
 
 	"github.com/Azure/azure-sdk-for-go/management"
 	"github.com/Azure/azure-sdk-for-go/management/location"
@@ -75,8 +80,25 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
+	if config.storageContainerCreated {
+		ui.Message(fmt.Sprintf("Created storage container %q", config.StorageContainer))
+		if config.RemoveCreatedContainerOnFailure {
+			journalResource(state, KindContainer, fmt.Sprintf("%s/%s", config.StorageAccount, config.StorageContainer))
+		}
+	}
 	ui.Message(fmt.Sprintf("Destination VHD: %s", destinationVhd))
 
+	log.Printf("Storage account type: %s", config.storageAccountType)
+	tiers, err := validatePremiumStorage(config, config.storageAccountType)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	for _, tier := range tiers {
+		ui.Message(tier)
+	}
+
 	if err := func() error {
 		if config.RemoteSourceImageLink != "" {
 			ui.Message("Checking remote image source link...")
@@ -94,7 +116,16 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 			size := float64(response.ContentLength) / 1024 / 1024 / 1024
 			ui.Say(fmt.Sprintf("Remote image size: %.1f GiB", size))
 
+			ui.Message("Checking remote image VHD footer...")
+			if err := checkRemoteVhdFooter(config.RemoteSourceImageLink, response.ContentLength); err != nil {
+				return err
+			}
+
 			vmutils.ConfigureDeploymentFromRemoteImage(&role, config.RemoteSourceImageLink, config.OSType, fmt.Sprintf("%s-OSDisk", config.tmpVmName), destinationVhd, "")
+			config.sourceImageName = config.RemoteSourceImageLink
+			if lastModified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+				config.sourceImagePublishedDate = lastModified.UTC().Format(time.RFC3339)
+			}
 			if config.ResizeOSVhdGB != nil {
 				if float64(*config.ResizeOSVhdGB) < size {
 					return fmt.Errorf("new OS VHD size of %d GiB is smaller than current size of %.1f GiB", *config.ResizeOSVhdGB, size)
@@ -103,6 +134,30 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 				role.OSVirtualHardDisk.ResizedSizeInGB = *config.ResizeOSVhdGB
 			}
 
+		} else if config.SourceVhdPath != "" {
+			fi, err := os.Stat(config.SourceVhdPath)
+			if err != nil {
+				return err
+			}
+			// the virtual size, dynamic VHDs are smaller on disk
+			virtualSize, err := vhd.VirtualSize(config.SourceVhdPath)
+			if err != nil {
+				return fmt.Errorf("Error reading source_vhd_path: %v", err)
+			}
+			size := float64(virtualSize) / 1024 / 1024 / 1024
+			ui.Message(fmt.Sprintf("Image source is local VHD %q (%.1f GiB), it will be registered as OS image %q", config.SourceVhdPath, size, config.tmpOSImageName))
+
+			vmutils.ConfigureDeploymentFromPlatformImage(&role, config.tmpOSImageName, destinationVhd, "")
+			config.sourceImageName = config.SourceVhdPath
+			config.sourceImagePublishedDate = fi.ModTime().UTC().Format(time.RFC3339)
+			if config.ResizeOSVhdGB != nil {
+				if float64(*config.ResizeOSVhdGB) < size {
+					return fmt.Errorf("new OS VHD size of %d GiB is smaller than current size of %.1f GiB", *config.ResizeOSVhdGB, size)
+				}
+				ui.Say(fmt.Sprintf("OS image will be resized to %d GiB", *config.ResizeOSVhdGB))
+				role.OSVirtualHardDisk.ResizedSizeInGB = *config.ResizeOSVhdGB
+			}
+
 		} else {
 			ui.Message("Checking image source...")
 			imageList, err := osimage.NewClient(client).ListOSImages()
@@ -114,6 +169,8 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 			if osImage, found := FindOSImage(imageList.OSImages, config.OSImageName, config.OSImageLabel, config.Location); found {
 				vmutils.ConfigureDeploymentFromPlatformImage(&role, osImage.Name, destinationVhd, "")
 				ui.Message(fmt.Sprintf("Image source is OS image %q", osImage.Name))
+				config.sourceImageName = osImage.Name
+				config.sourceImagePublishedDate = osImage.PublishedDate
 				if osImage.OS != config.OSType {
 					return fmt.Errorf("OS image type (%q) does not match config (%q)", osImage.OS, config.OSType)
 				}
@@ -150,6 +207,8 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 					}
 
 					ui.Message(fmt.Sprintf("Image source is VM image %q", vmImage.Name))
+					config.sourceImageName = vmImage.Name
+					config.sourceImagePublishedDate = vmImage.PublishedDate
 					if vmImage.OSDiskConfiguration.OS != config.OSType {
 						return fmt.Errorf("VM image type (%q) does not match config (%q)", vmImage.OSDiskConfiguration.OS, config.OSType)
 					}
@@ -166,6 +225,10 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
+	if role.OSVirtualHardDisk != nil {
+		role.OSVirtualHardDisk.HostCaching = vmdisk.HostCachingType(config.OSDiskCaching)
+	}
+
 	if config.OSType == constants.Target_Linux {
 		certThumbprint := state.Get(constants.Thumbprint).(string)
 		if len(certThumbprint) == 0 {
@@ -174,20 +237,32 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
-		vmutils.ConfigureForLinux(&role, config.tmpVmName, config.UserName, "", certThumbprint)
+		vmutils.ConfigureForLinux(&role, config.tmpVmName, config.UserName, config.Comm.SSHPassword, certThumbprint)
 
 		// disallowing password login is irreversible on some images, see https://github.com/Azure/packer-azure/issues/62
 		for i, _ := range role.ConfigurationSets {
 			if role.ConfigurationSets[i].ConfigurationSetType == vm.ConfigurationSetTypeLinuxProvisioning {
 				role.ConfigurationSets[i].DisableSSHPasswordAuthentication = "false"
+				role.ConfigurationSets[i].CustomData = config.customData
 			}
 		}
 
 		vmutils.ConfigureWithPublicSSH(&role)
 	} else if config.OSType == constants.Target_Windows {
-		password := common.RandomPassword()
-		state.Put("password", password)
-		vmutils.ConfigureForWindows(&role, config.tmpVmName, config.UserName, password, true, "")
+		state.Put("password", config.tmpAdminPassword)
+		vmutils.ConfigureForWindows(&role, config.tmpVmName, config.UserName, config.tmpAdminPassword, *config.EnableAutomaticUpdates, config.TimeZone)
+		for i := range role.ConfigurationSets {
+			if role.ConfigurationSets[i].ConfigurationSetType == vm.ConfigurationSetTypeWindowsProvisioning {
+				for _, c := range config.StoredCertificates {
+					role.ConfigurationSets[i].StoredCertificateSettings = append(role.ConfigurationSets[i].StoredCertificateSettings, vm.CertificateSetting{
+						StoreLocation: c.StoreLocation,
+						StoreName:     c.StoreName,
+						Thumbprint:    c.thumbprint,
+					})
+				}
+				role.ConfigurationSets[i].AdditionalUnattendContent = config.additionalUnattendContent
+			}
+		}
 		vmutils.ConfigureWithPublicRDP(&role)
 		vmutils.ConfigureWithPublicPowerShell(&role)
 	}
@@ -202,16 +277,25 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 		vmutils.ConfigureWithSubnet(&role, config.Subnet)
 	}
 
+	if config.ReservedIPName != "" {
+		ui.Message("Checking reserved IP...")
+		if err := checkReservedIP(client, config.ReservedIPName, config.Location, config.tmpServiceName); err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	for n, d := range config.DataDisks {
 		switch d := d.(type) {
 		case int:
 			ui.Message(fmt.Sprintf("Configuring datadisk %d: new disk with size %d GB...", n, d))
 			destination := fmt.Sprintf("%s-data-%d.vhd", destinationVhd[:len(destinationVhd)-4], n)
 			ui.Message(fmt.Sprintf("Destination VHD for data disk %s: %d", destinationVhd, n))
-			vmutils.ConfigureWithNewDataDisk(&role, "", destination, d, vmdisk.HostCachingTypeNone)
+			vmutils.ConfigureWithNewDataDisk(&role, "", destination, d, vmdisk.HostCachingType(config.DataDiskCaching))
 		case string:
 			ui.Message(fmt.Sprintf("Configuring datadisk %d: existing blob (%s)...", n, d))
-			vmutils.ConfigureWithVhdDataDisk(&role, d, vmdisk.HostCachingTypeNone)
+			vmutils.ConfigureWithVhdDataDisk(&role, d, vmdisk.HostCachingType(config.DataDiskCaching))
 		default:
 			err := fmt.Errorf("Datadisk %d is not a string nor a number", n)
 			state.Put("error", err)
@@ -226,7 +310,20 @@ func (*StepValidate) Run(state multistep.StateBag) multistep.StepAction {
 	return multistep.ActionContinue
 }
 
-func (*StepValidate) Cleanup(multistep.StateBag) {}
+func (*StepValidate) Cleanup(state multistep.StateBag) {
+	ui := state.Get(constants.Ui).(packer.Ui)
+	config := state.Get(constants.Config).(*Config)
+
+	if config.storageContainerCreated && config.RemoveCreatedContainerOnFailure && common.IsStateFailed(state) {
+		ui.Say(fmt.Sprintf("Removing storage container %q created by the build...", config.StorageContainer))
+
+		if err := config.storageClient.GetBlobService().DeleteContainer(config.StorageContainer); err != nil {
+			ui.Error(fmt.Sprintf("Error removing storage container: %s", err))
+			return
+		}
+		config.storageContainerCreated = false
+	}
+}
 
 func validateStorageAccount(config *Config, client management.Client) (string, error) {
 	ssc := storageservice.NewClient(client)
@@ -236,9 +333,24 @@ func validateStorageAccount(config *Config, client management.Client) (string, e
 		return "", err
 	}
 
-	if sa.StorageServiceProperties.Location != config.Location {
+	props, err := getStorageAccountProperties(client, config.StorageAccount)
+	if err != nil {
+		return "", err
+	}
+	config.storageAccountType = props.AccountType
+
+	saLocation := sa.StorageServiceProperties.Location
+	if saLocation == "" {
+		// accounts in an affinity group have no location
+		if props.AffinityGroup != "" {
+			if saLocation, err = getAffinityGroupLocation(client, props.AffinityGroup); err != nil {
+				return "", err
+			}
+		}
+	}
+	if saLocation != config.Location {
 		return "", fmt.Errorf("Storage account %q is not in location %q, but in location %q.",
-			config.StorageAccount, config.Location, sa.StorageServiceProperties.Location)
+			config.StorageAccount, config.Location, saLocation)
 	}
 
 	var blobEndpoint string
@@ -266,6 +378,11 @@ func validateStorageAccount(config *Config, client management.Client) (string, e
 		return "", fmt.Errorf("Could not create storage client for account %q", config.StorageAccount)
 	}
 
+	log.Printf("Checking for container %q...", config.StorageContainer)
+	config.storageContainerCreated, err = config.storageClient.GetBlobService().CreateContainerIfNotExists(config.StorageContainer, storage.ContainerAccessTypePrivate)
+	if err != nil {
+		return "", fmt.Errorf("Could not create container %q in storage account %q: %v", config.StorageContainer, config.StorageAccount, err)
+	}
 	return fmt.Sprintf("%s%s/%s.vhd", blobEndpoint, config.StorageContainer, config.tmpVmName), nil
 }
 
@@ -315,6 +432,51 @@ func checkVirtualNetworkConfiguration(client management.Client, vnetname, subnet
 	return fmt.Errorf("Could not find vnet %q and subnet %q in network configuration: %v", vnetname, subnetname, vnetConfig)
 }
 
+// storageAccountProperties are the properties of a storage account that the
+// SDK does not decode.
+type storageAccountProperties struct {
+	AffinityGroup string `xml:"StorageServiceProperties>AffinityGroup"`
+	AccountType   string `xml:"StorageServiceProperties>AccountType"`
+}
+
+func getStorageAccountProperties(client management.Client, name string) (storageAccountProperties, error) {
+	var props storageAccountProperties
+	d, err := client.SendAzureGetRequest(fmt.Sprintf("services/storageservices/%s", name))
+	if err != nil {
+		return props, err
+	}
+	err = xml.Unmarshal(d, &props)
+	return props, err
+}
+
+// checkReservedIP checks that the reserved IP exists in the location and is
+// not used by another service than serviceName, which uses it when a build
+// is resumed.
+func checkReservedIP(client management.Client, name, location, serviceName string) error {
+	d, err := client.SendAzureGetRequest(fmt.Sprintf("services/networking/reservedips/%s", name))
+	if err != nil {
+		return err
+	}
+
+	var reservedIP struct {
+		Address     string
+		Location    string
+		InUse       bool
+		ServiceName string
+	}
+	if err := xml.Unmarshal(d, &reservedIP); err != nil {
+		return err
+	}
+
+	if reservedIP.Location != location {
+		return fmt.Errorf("Reserved IP %q is not in location %q, but in %q", name, location, reservedIP.Location)
+	}
+	if reservedIP.InUse && reservedIP.ServiceName != serviceName {
+		return fmt.Errorf("Reserved IP %q (%s) is in use by service %q", name, reservedIP.Address, reservedIP.ServiceName)
+	}
+	return nil
+}
+
 func getAffinityGroupLocation(client management.Client, affinityGroup string) (string, error) {
 	const getAffinityGroupProperties = "affinitygroups/%s"
 	d, err := client.SendAzureGetRequest(fmt.Sprintf(getAffinityGroupProperties, affinityGroup))
@@ -329,3 +491,42 @@ func getAffinityGroupLocation(client management.Client, affinityGroup string) (s
 
 	return afGroup.Location, err
 }
+
+// checkRemoteVhdFooter downloads the footer of a remote VHD and checks that
+// Azure accepts the VHD. Servers that do not support range requests are not
+// checked.
+func checkRemoteVhdFooter(link string, size int64) error {
+	if size < vhd.FooterSize {
+		return fmt.Errorf("remote image of %d bytes is too small to be a VHD", size)
+	}
+
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", size-vhd.FooterSize, size-1))
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error retrieving remote image VHD footer: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusPartialContent {
+		log.Printf("Server did not return partial content (%s), skipping VHD footer check", response.Status)
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(response.Body, vhd.FooterSize))
+	if err != nil {
+		return fmt.Errorf("error retrieving remote image VHD footer: %v", err)
+	}
+	footer, err := vhd.ParseFooter(b)
+	if err != nil {
+		return fmt.Errorf("remote image is not a valid VHD: %v", err)
+	}
+	if err := footer.Validate(); err != nil {
+		return fmt.Errorf("remote image is not a valid VHD for Azure: %v", err)
+	}
+	return nil
+}
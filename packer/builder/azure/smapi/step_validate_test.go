@@ -0,0 +1,89 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/vhd"
+
+	. "gopkg.in/check.v1"
+)
+
+type StepValidateSuite struct{}
+
+var _ = Suite(&StepValidateSuite{})
+
+func (s *StepValidateSuite) Test_CheckRemoteVhdFooter(c *C) {
+	var footer []byte
+	rangeSupported := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rangeSupported {
+			w.Write(footer)
+			return
+		}
+		c.Check(r.Header.Get("Range"), Equals, "bytes=1048576-1049087")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(footer)
+	}))
+	defer ts.Close()
+
+	const size = vhd.MiB + vhd.FooterSize
+
+	footer = vhd.NewFixedFooter(vhd.MiB).Bytes()
+	c.Check(checkRemoteVhdFooter(ts.URL, size), IsNil)
+
+	footer = vhd.NewFixedFooter(vhd.MiB + vhd.SectorSize).Bytes()
+	c.Check(checkRemoteVhdFooter(ts.URL, size), ErrorMatches, "remote image is not a valid VHD for Azure: .*")
+
+	footer = make([]byte, vhd.FooterSize)
+	c.Check(checkRemoteVhdFooter(ts.URL, size), ErrorMatches, "remote image is not a valid VHD: .*")
+
+	rangeSupported = false
+	c.Check(checkRemoteVhdFooter(ts.URL, size), IsNil)
+
+	c.Check(checkRemoteVhdFooter(ts.URL, 100), NotNil)
+}
+
+func (s *StepValidateSuite) Test_CheckReservedIP(c *C) {
+	client := &getClient{response: `<ReservedIP xmlns="http://schemas.microsoft.com/windowsazure">
+  <Name>build-ip</Name>
+  <Address>23.96.1.2</Address>
+  <State>Created</State>
+  <InUse>false</InUse>
+  <Location>West US</Location>
+</ReservedIP>`}
+
+	c.Assert(checkReservedIP(client, "build-ip", "West US", "PkrSrvx"), IsNil)
+	c.Check(client.url, Equals, "services/networking/reservedips/build-ip")
+	c.Assert(checkReservedIP(client, "build-ip", "East US", "PkrSrvx"), ErrorMatches, `Reserved IP "build-ip" is not in location "East US", but in "West US"`)
+
+	client.response = `<ReservedIP xmlns="http://schemas.microsoft.com/windowsazure">
+  <Name>build-ip</Name>
+  <Address>23.96.1.2</Address>
+  <InUse>true</InUse>
+  <ServiceName>other</ServiceName>
+  <Location>West US</Location>
+</ReservedIP>`
+	c.Assert(checkReservedIP(client, "build-ip", "West US", "PkrSrvx"), ErrorMatches, `Reserved IP "build-ip" \(23.96.1.2\) is in use by service "other"`)
+	c.Assert(checkReservedIP(client, "build-ip", "West US", "other"), IsNil)
+}
+
+func (s *StepValidateSuite) Test_GetStorageAccountProperties(c *C) {
+	client := &getClient{response: `<StorageService xmlns="http://schemas.microsoft.com/windowsazure">
+  <ServiceName>mysa</ServiceName>
+  <StorageServiceProperties>
+    <AffinityGroup>build-group</AffinityGroup>
+    <AccountType>Premium_LRS</AccountType>
+    <Label>bXlzYQ==</Label>
+  </StorageServiceProperties>
+</StorageService>`}
+
+	props, err := getStorageAccountProperties(client, "mysa")
+	c.Assert(err, IsNil)
+	c.Check(client.url, Equals, "services/storageservices/mysa")
+	c.Check(props.AffinityGroup, Equals, "build-group")
+	c.Check(props.AccountType, Equals, "Premium_LRS")
+}
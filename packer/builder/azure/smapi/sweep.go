@@ -0,0 +1,357 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common"
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/management/hostedservice"
+	"github.com/Azure/azure-sdk-for-go/management/osimage"
+	"github.com/Azure/azure-sdk-for-go/management/storageservice"
+	vmdisk "github.com/Azure/azure-sdk-for-go/management/virtualmachinedisk"
+	vmimage "github.com/Azure/azure-sdk-for-go/management/virtualmachineimage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// Name prefixes of the temporary resources created by the builder.
+const (
+	sweepServicePrefix   = "PkrSrv"
+	sweepVmPrefix        = "PkrVM"
+	sweepContainerPrefix = "packer-provision-"
+)
+
+// Kinds of orphaned resources, in the order they are deleted. Services are
+// deleted first, which releases their disks and VHDs.
+const (
+	KindHostedService = "hosted service"
+	KindDisk          = "disk"
+	KindBlob          = "blob"
+	KindContainer     = "container"
+)
+
+// SweepConfig selects the orphaned resources.
+type SweepConfig struct {
+	// MinAge is the minimum age of a resource, younger resources may
+	// belong to a running build.
+	MinAge time.Duration
+
+	// Allowlist holds name patterns (see path.Match) of resources that are
+	// never deleted. Blobs and containers are matched as
+	// account/container[/blob] as well as by their name.
+	Allowlist []string
+
+	// StorageAccounts limits the search for VHDs and containers, all
+	// storage accounts of the subscription are searched if it is empty.
+	StorageAccounts []string
+
+	// IncludeVhds also selects the PkrVM* VHDs that back no disk or image.
+	// These include the outputs of VHD-only builds that were not moved, so
+	// they are only deleted on request.
+	IncludeVhds bool
+}
+
+// OrphanedResource is a leftover of a build that can be deleted.
+type OrphanedResource struct {
+	Kind    string
+	Name    string
+	Created time.Time
+
+	delete func() error
+}
+
+func (r OrphanedResource) String() string {
+	return fmt.Sprintf("%s %s (created %s)", r.Kind, r.Name, r.Created.Format(time.RFC3339))
+}
+
+// Delete deletes the resource, retrying on conflicts.
+func (r OrphanedResource) Delete() error {
+	return r.delete()
+}
+
+// FindOrphanedResources lists the temporary resources of the builder that are
+// older than MinAge and not allowlisted.
+func FindOrphanedResources(client management.Client, config SweepConfig) ([]OrphanedResource, error) {
+	var resources []OrphanedResource
+	cutoff := time.Now().Add(-config.MinAge)
+
+	add := func(r OrphanedResource, names ...string) {
+		if r.Created.IsZero() || r.Created.After(cutoff) {
+			log.Printf("Sweep: skipping %s, too young or unknown age", r)
+			return
+		}
+		for _, pattern := range config.Allowlist {
+			for _, name := range append(names, r.Name) {
+				if ok, _ := path.Match(pattern, name); ok {
+					log.Printf("Sweep: skipping %s, allowlisted by %q", r, pattern)
+					return
+				}
+			}
+		}
+		resources = append(resources, r)
+	}
+
+	services, err := listHostedServices(client)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing hosted services: %v", err)
+	}
+	for _, s := range services {
+		if !strings.HasPrefix(s.ServiceName, sweepServicePrefix) {
+			continue
+		}
+		name := s.ServiceName
+		add(OrphanedResource{
+			Kind:    KindHostedService,
+			Name:    name,
+			Created: parseSweepTime(s.DateCreated),
+			delete: func() error {
+				return ignoreNotFound(retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+					return hostedservice.NewClient(client).DeleteHostedService(name, true)
+				}))
+			},
+		})
+	}
+
+	disks, err := vmdisk.NewClient(client).ListDisks()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing disks: %v", err)
+	}
+	inUse, err := vhdsInUse(client, disks)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range disks.Disk {
+		if !strings.HasPrefix(d.Name, sweepServicePrefix) && !strings.HasPrefix(d.Name, sweepVmPrefix) {
+			continue
+		}
+		if d.AttachedTo.HostedServiceName != "" {
+			// removed with its service
+			continue
+		}
+		name := d.Name
+		add(OrphanedResource{
+			Kind:    KindDisk,
+			Name:    name,
+			Created: parseSweepTime(d.CreatedTime),
+			delete: func() error {
+				return ignoreNotFound(retry.ExecuteOperation(func() error {
+					return vmdisk.NewClient(client).DeleteDisk(name, true)
+				}))
+			},
+		})
+	}
+
+	accounts := config.StorageAccounts
+	if len(accounts) == 0 {
+		list, err := storageservice.NewClient(client).ListStorageServices()
+		if err != nil {
+			return nil, fmt.Errorf("Error listing storage accounts: %v", err)
+		}
+		for _, s := range list.StorageServices {
+			accounts = append(accounts, s.ServiceName)
+		}
+	}
+
+	var blobs, containers []storageCandidate
+	for _, account := range accounts {
+		key, err := StorageAccountKey(client, account)
+		if err != nil {
+			return nil, err
+		}
+		storageClient, err := storage.NewBasicClient(account, key)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating storage client for %q: %v", account, err)
+		}
+		b, c, err := findOrphanedStorage(storageClient.GetBlobService(), account, inUse, config.IncludeVhds)
+		if err != nil {
+			return nil, fmt.Errorf("Error searching storage account %q: %v", account, err)
+		}
+		blobs = append(blobs, b...)
+		containers = append(containers, c...)
+	}
+
+	for _, c := range append(blobs, containers...) {
+		add(c.resource, c.names...)
+	}
+
+	return resources, nil
+}
+
+// storageCandidate is an orphaned blob or container with the names it can
+// be allowlisted by.
+type storageCandidate struct {
+	resource OrphanedResource
+	names    []string
+}
+
+// findOrphanedStorage lists the temporary provisioning containers in a
+// storage account and, if includeVhds is set, the VHDs of temporary VMs that
+// are not in use.
+func findOrphanedStorage(blobService storage.BlobStorageClient, account string, inUse map[string]bool, includeVhds bool) (blobs, containers []storageCandidate, err error) {
+	params := storage.ListContainersParameters{}
+	for {
+		list, err := blobService.ListContainers(params)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, c := range list.Containers {
+			container := c.Name
+			if strings.HasPrefix(container, sweepContainerPrefix) && c.Properties.LeaseState != "leased" {
+				containers = append(containers, storageCandidate{
+					resource: OrphanedResource{
+						Kind:    KindContainer,
+						Name:    fmt.Sprintf("%s/%s", account, container),
+						Created: parseSweepTime(c.Properties.LastModified),
+						delete: func() error {
+							return retry.ExecuteOperation(func() error {
+								_, err := blobService.DeleteContainerIfExists(container)
+								return err
+							})
+						},
+					},
+					names: []string{container},
+				})
+			}
+
+			if !includeVhds {
+				continue
+			}
+			b, err := findOrphanedVhds(blobService, account, container, inUse)
+			if err != nil {
+				return nil, nil, err
+			}
+			blobs = append(blobs, b...)
+		}
+
+		if list.NextMarker == "" {
+			return blobs, containers, nil
+		}
+		params.Marker = list.NextMarker
+	}
+}
+
+func findOrphanedVhds(blobService storage.BlobStorageClient, account, container string, inUse map[string]bool) (blobs []storageCandidate, err error) {
+	params := storage.ListBlobsParameters{Prefix: sweepVmPrefix}
+	for {
+		list, err := blobService.ListBlobs(container, params)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range list.Blobs {
+			blob := b.Name
+			if !strings.HasSuffix(blob, ".vhd") || inUse[vhdKey(account, container, blob)] {
+				continue
+			}
+			blobs = append(blobs, storageCandidate{
+				resource: OrphanedResource{
+					Kind:    KindBlob,
+					Name:    fmt.Sprintf("%s/%s/%s", account, container, blob),
+					Created: parseSweepTime(b.Properties.LastModified),
+					delete: func() error {
+						return retry.ExecuteOperation(func() error {
+							_, err := blobService.DeleteBlobIfExists(container, blob, nil)
+							return err
+						})
+					},
+				},
+				names: []string{blob, fmt.Sprintf("%s/%s", container, blob)},
+			})
+		}
+
+		if list.NextMarker == "" {
+			return blobs, nil
+		}
+		params.Marker = list.NextMarker
+	}
+}
+
+// vhdsInUse returns the VHDs that back disks, VM images and OS images, keyed
+// by vhdKey.
+func vhdsInUse(client management.Client, disks vmdisk.ListDiskResponse) (map[string]bool, error) {
+	var links []string
+	for _, d := range disks.Disk {
+		links = append(links, d.MediaLink)
+	}
+
+	vmImages, err := vmimage.NewClient(client).ListVirtualMachineImages(vmimage.ListParameters{Category: vmimage.CategoryUser})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing VM images: %v", err)
+	}
+	for _, i := range vmImages.VMImages {
+		links = append(links, i.OSDiskConfiguration.MediaLink)
+		for _, d := range i.DataDiskConfigurations {
+			links = append(links, d.MediaLink)
+		}
+	}
+
+	osImages, err := osimage.NewClient(client).ListOSImages()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing OS images: %v", err)
+	}
+	for _, i := range osImages.OSImages {
+		links = append(links, i.MediaLink)
+	}
+
+	inUse := make(map[string]bool)
+	for _, link := range links {
+		if b, err := common.ParseBlobURL(link); err == nil {
+			inUse[vhdKey(b.StorageAccount, b.Container, b.Blob)] = true
+		}
+	}
+	return inUse, nil
+}
+
+func vhdKey(account, container, blob string) string {
+	return strings.ToLower(fmt.Sprintf("%s/%s/%s", account, container, blob))
+}
+
+// listHostedServices lists the hosted services with their creation date,
+// which the SDK does not decode.
+func listHostedServices(client management.Client) ([]sweepHostedService, error) {
+	response, err := client.SendAzureGetRequest("services/hostedservices")
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		HostedServices []sweepHostedService `xml:"HostedService"`
+	}
+	if err := xml.Unmarshal(response, &list); err != nil {
+		return nil, err
+	}
+	return list.HostedServices, nil
+}
+
+type sweepHostedService struct {
+	ServiceName string
+	DateCreated string `xml:"HostedServiceProperties>DateCreated"`
+}
+
+// parseSweepTime parses the time formats of the management and the storage
+// APIs, it returns the zero time if s cannot be parsed.
+func parseSweepTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, time.RFC1123} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func ignoreNotFound(err error) error {
+	if management.IsResourceNotFoundError(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// listClient answers GET requests by path, ignoring the query string.
+type listClient struct {
+	management.Client
+	responses map[string]string
+}
+
+func (c *listClient) SendAzureGetRequest(url string) ([]byte, error) {
+	path := strings.SplitN(url, "?", 2)[0]
+	response, ok := c.responses[path]
+	if !ok {
+		return nil, fmt.Errorf("unexpected request %s", url)
+	}
+	return []byte(response), nil
+}
+
+func TestFindOrphanedResources(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	young := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	client := &listClient{responses: map[string]string{
+		"services/hostedservices": `<HostedServices xmlns="http://schemas.microsoft.com/windowsazure">
+  <HostedService><ServiceName>PkrSrvold</ServiceName><HostedServiceProperties><DateCreated>` + old + `</DateCreated></HostedServiceProperties></HostedService>
+  <HostedService><ServiceName>PkrSrvyoung</ServiceName><HostedServiceProperties><DateCreated>` + young + `</DateCreated></HostedServiceProperties></HostedService>
+  <HostedService><ServiceName>PkrSrvkeep</ServiceName><HostedServiceProperties><DateCreated>` + old + `</DateCreated></HostedServiceProperties></HostedService>
+  <HostedService><ServiceName>production</ServiceName><HostedServiceProperties><DateCreated>` + old + `</DateCreated></HostedServiceProperties></HostedService>
+</HostedServices>`,
+		"services/disks": `<Disks xmlns="http://schemas.microsoft.com/windowsazure">
+  <Disk><Name>PkrSrvold-PkrVMold-0-201510010000</Name><CreatedTime>` + old + `</CreatedTime></Disk>
+  <Disk><Name>PkrSrvrun-PkrVMrun-0-201510010000</Name><CreatedTime>` + old + `</CreatedTime><AttachedTo><HostedServiceName>PkrSrvrun</HostedServiceName></AttachedTo></Disk>
+  <Disk><Name>data</Name><CreatedTime>` + old + `</CreatedTime></Disk>
+</Disks>`,
+		"services/vmimages":        `<VMImages xmlns="http://schemas.microsoft.com/windowsazure"></VMImages>`,
+		"services/images":          `<Images xmlns="http://schemas.microsoft.com/windowsazure"></Images>`,
+		"services/storageservices": `<StorageServices xmlns="http://schemas.microsoft.com/windowsazure"></StorageServices>`,
+	}}
+
+	resources, err := FindOrphanedResources(client, SweepConfig{
+		MinAge:    24 * time.Hour,
+		Allowlist: []string{"*keep"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for _, r := range resources {
+		found = append(found, r.Kind+" "+r.Name)
+	}
+	expected := []string{
+		"hosted service PkrSrvold",
+		"disk PkrSrvold-PkrVMold-0-201510010000",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q, got %q", expected, found)
+	}
+}
+
+func TestFindOrphanedStorage(t *testing.T) {
+	modified := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC1123)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/" && r.URL.Query().Get("comp") == "list":
+			fmt.Fprint(w, `<EnumerationResults><Containers>
+  <Container><Name>packer-provision-old</Name><Properties><Last-Modified>`+modified+`</Last-Modified><LeaseState>available</LeaseState></Properties></Container>
+  <Container><Name>packer-provision-leased</Name><Properties><Last-Modified>`+modified+`</Last-Modified><LeaseState>leased</LeaseState></Properties></Container>
+  <Container><Name>vhds</Name><Properties><Last-Modified>`+modified+`</Last-Modified></Properties></Container>
+</Containers></EnumerationResults>`)
+		case r.URL.Path == "/vhds" && r.URL.Query().Get("restype") == "container":
+			fmt.Fprint(w, `<EnumerationResults><Blobs>
+  <Blob><Name>PkrVMold-os.vhd</Name><Properties><Last-Modified>`+modified+`</Last-Modified></Properties></Blob>
+  <Blob><Name>PkrVMused-os.vhd</Name><Properties><Last-Modified>`+modified+`</Last-Modified></Properties></Blob>
+  <Blob><Name>PkrVMold.status</Name><Properties><Last-Modified>`+modified+`</Last-Modified></Properties></Blob>
+</Blobs></EnumerationResults>`)
+		case r.URL.Query().Get("restype") == "container":
+			fmt.Fprint(w, `<EnumerationResults><Blobs></Blobs></EnumerationResults>`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	storageClient, err := storage.NewClient("account", "a2V5", storage.DefaultBaseURL, storage.DefaultAPIVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every storage request goes to the test server
+	storageClient.HTTPClient = &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, ts.Listener.Addr().String())
+		},
+	}}
+	blobService := storageClient.GetBlobService()
+	inUse := map[string]bool{vhdKey("account", "vhds", "PkrVMused-os.vhd"): true}
+
+	names := func(candidates []storageCandidate) []string {
+		var names []string
+		for _, c := range candidates {
+			names = append(names, c.resource.Kind+" "+c.resource.Name)
+		}
+		return names
+	}
+
+	blobs, containers, err := findOrphanedStorage(blobService, "account", inUse, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("expected no VHDs without includeVhds, got %q", names(blobs))
+	}
+	if expected := []string{"container account/packer-provision-old"}; !reflect.DeepEqual(names(containers), expected) {
+		t.Errorf("expected %q, got %q", expected, names(containers))
+	}
+
+	blobs, _, err = findOrphanedStorage(blobService, "account", inUse, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"blob account/vhds/PkrVMold-os.vhd"}; !reflect.DeepEqual(names(blobs), expected) {
+		t.Errorf("expected %q, got %q", expected, names(blobs))
+	}
+	if blobs[0].resource.Created.IsZero() {
+		t.Errorf("creation time of the VHD not parsed")
+	}
+}
+
+func TestParseSweepTime(t *testing.T) {
+	expected := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, s := range []string{"2015-10-01T12:00:00Z", "2015-10-01T12:00:00.1234567Z", "Thu, 01 Oct 2015 12:00:00 GMT"} {
+		if parsed := parseSweepTime(s); !parsed.Truncate(time.Second).Equal(expected) {
+			t.Errorf("unexpected time for %q: %s", s, parsed)
+		}
+	}
+	if !parseSweepTime("yesterday").IsZero() {
+		t.Errorf("expected zero time for an invalid time")
+	}
+}
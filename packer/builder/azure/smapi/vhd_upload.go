@@ -0,0 +1,88 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/vhd"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// pageBlobWriter is the subset of storage.BlobStorageClient that is needed
+// to upload a page blob.
+type pageBlobWriter interface {
+	PutPageBlob(container, name string, size int64, extraHeaders map[string]string) error
+	PutPage(container, name string, startByte, endByte int64, writeType storage.PageWriteType, chunk []byte, extraHeaders map[string]string) error
+}
+
+// uploadPageBlob uploads size bytes read from r as a page blob. Pages that
+// only contain zeros are skipped, a new page blob reads as zeros anyway.
+// report is called with the number of bytes processed so far, a non-nil
+// error returned by report aborts the upload.
+func uploadPageBlob(blobs pageBlobWriter, container, name string, r io.ReaderAt, size int64, report func(done int64) error) error {
+	if size%vhd.SectorSize != 0 {
+		return fmt.Errorf("size %d is not a multiple of %d bytes", size, vhd.SectorSize)
+	}
+
+	if err := blobs.PutPageBlob(container, name, size, nil); err != nil {
+		return err
+	}
+
+	buf := make([]byte, storage.MaxBlobPageSize)
+	for offset := int64(0); offset < size; offset += int64(len(buf)) {
+		if remaining := size - offset; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		if _, err := r.ReadAt(buf, offset); err != nil {
+			return err
+		}
+
+		for _, p := range nonZeroPages(buf) {
+			if err := blobs.PutPage(container, name, offset+p.Start, offset+p.End, storage.PageWriteTypeUpdate, buf[p.Start:p.End+1], nil); err != nil {
+				return err
+			}
+		}
+
+		if err := report(offset + int64(len(buf))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nonZeroPages returns the ranges of buf that contain data, aligned to
+// vhd.SectorSize. End is inclusive.
+func nonZeroPages(buf []byte) []storage.PageRange {
+	var ranges []storage.PageRange
+	var current *storage.PageRange
+
+	for start := 0; start < len(buf); start += vhd.SectorSize {
+		end := start + vhd.SectorSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if isZero(buf[start:end]) {
+			current = nil
+			continue
+		}
+		if current == nil {
+			ranges = append(ranges, storage.PageRange{Start: int64(start)})
+			current = &ranges[len(ranges)-1]
+		}
+		current.End = int64(end - 1)
+	}
+	return ranges
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"bytes"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/common/vhd"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+
+	. "gopkg.in/check.v1"
+)
+
+type VhdUploadSuite struct{}
+
+var _ = Suite(&VhdUploadSuite{})
+
+type fakePageBlobWriter struct {
+	size  int64
+	pages []storage.PageRange
+	data  []byte
+}
+
+func (w *fakePageBlobWriter) PutPageBlob(container, name string, size int64, extraHeaders map[string]string) error {
+	w.size = size
+	w.data = make([]byte, size)
+	return nil
+}
+
+func (w *fakePageBlobWriter) PutPage(container, name string, startByte, endByte int64, writeType storage.PageWriteType, chunk []byte, extraHeaders map[string]string) error {
+	w.pages = append(w.pages, storage.PageRange{Start: startByte, End: endByte})
+	copy(w.data[startByte:], chunk)
+	return nil
+}
+
+func (s *VhdUploadSuite) Test_NonZeroPages(c *C) {
+	buf := make([]byte, 4*vhd.SectorSize)
+	buf[10] = 1
+	buf[vhd.SectorSize+1] = 1
+	buf[3*vhd.SectorSize+511] = 1
+
+	c.Check(nonZeroPages(buf), DeepEquals, []storage.PageRange{
+		{Start: 0, End: 2*vhd.SectorSize - 1},
+		{Start: 3 * vhd.SectorSize, End: 4*vhd.SectorSize - 1},
+	})
+	c.Check(nonZeroPages(make([]byte, vhd.SectorSize)), HasLen, 0)
+}
+
+func (s *VhdUploadSuite) Test_UploadPageBlob(c *C) {
+	size := int64(storage.MaxBlobPageSize + 2*vhd.SectorSize)
+	data := make([]byte, size)
+	data[0] = 1
+	data[storage.MaxBlobPageSize-1] = 2
+	data[storage.MaxBlobPageSize] = 3
+
+	w := &fakePageBlobWriter{}
+	var reported []int64
+	err := uploadPageBlob(w, "vhds", "disk.vhd", bytes.NewReader(data), size, func(done int64) error {
+		reported = append(reported, done)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Check(w.size, Equals, size)
+	c.Check(bytes.Equal(w.data, data), Equals, true)
+	c.Check(w.pages, DeepEquals, []storage.PageRange{
+		{Start: 0, End: vhd.SectorSize - 1},
+		{Start: storage.MaxBlobPageSize - vhd.SectorSize, End: storage.MaxBlobPageSize - 1},
+		{Start: storage.MaxBlobPageSize, End: storage.MaxBlobPageSize + vhd.SectorSize - 1},
+	})
+	c.Check(reported, DeepEquals, []int64{storage.MaxBlobPageSize, size})
+
+	c.Check(uploadPageBlob(w, "vhds", "disk.vhd", bytes.NewReader(data), size-1, func(int64) error { return nil }), NotNil)
+}
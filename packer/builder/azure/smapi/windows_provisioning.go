@@ -0,0 +1,294 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// UnattendContent is a setting that is added to the Unattend.xml file used
+// by Windows Setup.
+type UnattendContent struct {
+	Pass        string `mapstructure:"pass"`
+	Component   string `mapstructure:"component"`
+	Setting     string `mapstructure:"setting"`
+	Content     string `mapstructure:"content"`
+	ContentFile string `mapstructure:"content_file"`
+}
+
+// StoredCertificate is a PFX file that is uploaded to the temporary service
+// and installed into a certificate store of the VM.
+type StoredCertificate struct {
+	Path          string `mapstructure:"path"`
+	Password      string `mapstructure:"password"`
+	StoreName     string `mapstructure:"store_name"`
+	StoreLocation string `mapstructure:"store_location"`
+
+	data       []byte
+	thumbprint string
+}
+
+const (
+	defaultUnattendPass      = "oobeSystem"
+	defaultUnattendComponent = "Microsoft-Windows-Shell-Setup"
+	defaultStoreName         = "My"
+	defaultStoreLocation     = "LocalMachine"
+)
+
+var validUnattendSettings = map[string]bool{
+	"AutoLogon":          true,
+	"FirstLogonCommands": true,
+}
+
+// prepare sets the defaults and reads the content file if needed.
+func (u *UnattendContent) prepare() error {
+	if u.Pass == "" {
+		u.Pass = defaultUnattendPass
+	}
+	if u.Component == "" {
+		u.Component = defaultUnattendComponent
+	}
+
+	if u.Pass != defaultUnattendPass {
+		return fmt.Errorf("pass %q is not supported, must be %s", u.Pass, defaultUnattendPass)
+	}
+	if u.Component != defaultUnattendComponent {
+		return fmt.Errorf("component %q is not supported, must be %s", u.Component, defaultUnattendComponent)
+	}
+	if !validUnattendSettings[u.Setting] {
+		return fmt.Errorf("setting %q is not supported, must be AutoLogon or FirstLogonCommands", u.Setting)
+	}
+
+	if (u.Content == "") == (u.ContentFile == "") {
+		return fmt.Errorf("one and only one of content or content_file has to be specified")
+	}
+	if u.ContentFile != "" {
+		content, err := ioutil.ReadFile(u.ContentFile)
+		if err != nil {
+			return fmt.Errorf("content_file could not be read: %s", err)
+		}
+		u.Content = string(content)
+	}
+	return nil
+}
+
+// prepare sets the defaults, reads the PFX file and determines the
+// thumbprint of the certificate.
+func (c *StoredCertificate) prepare() error {
+	if c.StoreName == "" {
+		c.StoreName = defaultStoreName
+	}
+	if c.StoreLocation == "" {
+		c.StoreLocation = defaultStoreLocation
+	}
+	if c.StoreLocation != defaultStoreLocation {
+		return fmt.Errorf("store_location %q is not supported, must be %s", c.StoreLocation, defaultStoreLocation)
+	}
+
+	if c.Path == "" {
+		return fmt.Errorf("path must be specified")
+	}
+	data, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return fmt.Errorf("path could not be read: %s", err)
+	}
+	_, cert, err := pkcs12.Decode(data, c.Password)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid PFX file: %s", c.Path, err)
+	}
+
+	c.data = data
+	c.thumbprint = fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+	return nil
+}
+
+type additionalUnattendContent struct {
+	XMLName xml.Name       `xml:"AdditionalUnattendContent"`
+	Passes  []unattendPass `xml:"Passes>UnattendPass"`
+}
+
+type unattendPass struct {
+	PassName   string
+	Components []unattendComponent `xml:"Components>UnattendComponent"`
+}
+
+type unattendComponent struct {
+	ComponentName     string
+	ComponentSettings []unattendSetting `xml:"ComponentSettings>ComponentSetting"`
+}
+
+type unattendSetting struct {
+	SettingName string
+	Content     string
+}
+
+// marshalUnattendContent returns the AdditionalUnattendContent element for
+// the Windows provisioning configuration set, settings are grouped by pass
+// and component.
+func marshalUnattendContent(contents []UnattendContent) (string, error) {
+	var auc additionalUnattendContent
+	for _, c := range contents {
+		var pass *unattendPass
+		for i := range auc.Passes {
+			if auc.Passes[i].PassName == c.Pass {
+				pass = &auc.Passes[i]
+			}
+		}
+		if pass == nil {
+			auc.Passes = append(auc.Passes, unattendPass{PassName: c.Pass})
+			pass = &auc.Passes[len(auc.Passes)-1]
+		}
+
+		var component *unattendComponent
+		for i := range pass.Components {
+			if pass.Components[i].ComponentName == c.Component {
+				component = &pass.Components[i]
+			}
+		}
+		if component == nil {
+			pass.Components = append(pass.Components, unattendComponent{ComponentName: c.Component})
+			component = &pass.Components[len(pass.Components)-1]
+		}
+
+		component.ComponentSettings = append(component.ComponentSettings, unattendSetting{
+			SettingName: c.Setting,
+			Content:     base64.StdEncoding.EncodeToString([]byte(c.Content)),
+		})
+	}
+
+	data, err := xml.Marshal(auc)
+	return string(data), err
+}
+
+// marshalDeploymentRequest does what VirtualMachineClient.CreateDeployment
+// does, but also sends the elements of the Windows provisioning
+// configuration set that the SDK cannot express: EnableAutomaticUpdates set
+// to false and AdditionalUnattendContent, which is expected to hold the
+// element created by marshalUnattendContent.
+func marshalDeploymentRequest(role vm.Role, options vm.CreateDeploymentOptions) ([]byte, error) {
+	var winconfig vm.ConfigurationSet
+	role.ConfigurationSets = append([]vm.ConfigurationSet(nil), role.ConfigurationSets...)
+	for i := range role.ConfigurationSets {
+		if role.ConfigurationSets[i].ConfigurationSetType == vm.ConfigurationSetTypeWindowsProvisioning {
+			winconfig = role.ConfigurationSets[i]
+			role.ConfigurationSets[i].AdditionalUnattendContent = ""
+		}
+	}
+
+	data, err := xml.Marshal(vm.DeploymentRequest{
+		Name:               role.RoleName,
+		DeploymentSlot:     "Production",
+		Label:              role.RoleName,
+		RoleList:           []vm.Role{role},
+		DNSServers:         options.DNSServers,
+		LoadBalancers:      options.LoadBalancers,
+		ReservedIPName:     options.ReservedIPName,
+		VirtualNetworkName: options.VirtualNetworkName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if winconfig.ConfigurationSetType != vm.ConfigurationSetTypeWindowsProvisioning {
+		return data, nil
+	}
+
+	// the elements are inserted in the order required by the schema
+	if !winconfig.EnableAutomaticUpdates {
+		if data, err = insertAfter(data, "</AdminPassword>", "<EnableAutomaticUpdates>false</EnableAutomaticUpdates>"); err != nil {
+			return nil, err
+		}
+	}
+	if winconfig.AdditionalUnattendContent != "" {
+		if data, err = insertAfter(data, "</AdminUsername>", winconfig.AdditionalUnattendContent); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func insertAfter(data []byte, after, insert string) ([]byte, error) {
+	i := bytes.Index(data, []byte(after))
+	if i < 0 {
+		return nil, fmt.Errorf("deployment request has no %s element", after)
+	}
+	i += len(after)
+	return append(data[:i:i], append([]byte(insert), data[i:]...)...), nil
+}
+
+// createDeployment creates the deployment of role in the service.
+func createDeployment(client management.Client, role vm.Role, serviceName string, options vm.CreateDeploymentOptions) (management.OperationID, error) {
+	data, err := marshalDeploymentRequest(role, options)
+	if err != nil {
+		return "", err
+	}
+	return client.SendAzurePostRequest(fmt.Sprintf("services/hostedservices/%s/deployments", serviceName), data)
+}
+
+// reservedWindowsUserNames cannot be used as the administrator account name.
+var reservedWindowsUserNames = []string{
+	"1", "123", "a", "actuser", "adm", "admin", "admin1", "admin2",
+	"administrator", "aspnet", "backup", "console", "david", "guest", "john",
+	"owner", "root", "server", "sql", "support", "support_388945a0", "sys",
+	"test", "test1", "test2", "test3", "user", "user1", "user2", "user3",
+	"user4", "user5",
+}
+
+// validateWindowsUserName checks the administrator account name against
+// the rules of Windows provisioning.
+func validateWindowsUserName(name string) error {
+	if len(name) > 20 {
+		return fmt.Errorf("username %q is longer than 20 characters", name)
+	}
+	if strings.HasSuffix(name, ".") {
+		return fmt.Errorf("username %q cannot end with a period", name)
+	}
+	if i := strings.IndexAny(name, `\/"[]:|<>+=;,?*@`); i >= 0 {
+		return fmt.Errorf("username %q contains the invalid character %q", name, name[i])
+	}
+	for _, reserved := range reservedWindowsUserNames {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("username %q is reserved and cannot be used", name)
+		}
+	}
+	return nil
+}
+
+// validateWindowsPassword checks the administrator password against the
+// complexity rules of Windows provisioning: 8 to 123 characters and three of
+// lower case, upper case, digit and special characters.
+func validateWindowsPassword(password string) error {
+	if len(password) < 8 || len(password) > 123 {
+		return fmt.Errorf("password must be 8 to 123 characters long")
+	}
+
+	var lower, upper, digit, special int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			special = 1
+		}
+	}
+	if lower+upper+digit+special < 3 {
+		return fmt.Errorf("password must contain three of lower case, upper case, digit and special characters")
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azure
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	vm "github.com/Azure/azure-sdk-for-go/management/virtualmachine"
+	"github.com/Azure/azure-sdk-for-go/management/vmutils"
+)
+
+// testPfx is a self-signed certificate for CN=packer-test, password "secret"
+const testPfx = `
+MIIGAQIBAzCCBccGCSqGSIb3DQEHAaCCBbgEggW0MIIFsDCCAq8GCSqGSIb3DQEHBqCCAqAwggKc
+AgEAMIIClQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQMwDgQIUJCykDph4Y8CAggAgIICaGo4OyhO
+tbfCYyUlmj1WCFmQrXh1OEMkCwyA2MUcbBNwfGTq5MqeiKvEBs1MKLVW/TBrZ/WA2/GeZsvkdJEg
+zktc7dOi0UOSAqShiFzWzj3UDSfzCuAYzvwRvcbQNt7IbPy6TiSpHaq14m1zobyqLOL1JalqnvmI
+fY+TmT3hLb179Tmwhy3671guHuGKoPT6dyV2gRMWJAWlU1exGaFJPe5Ki6zTwiSBoEc//+B8+qMX
+pKuNxBZ2T/7QXMd4kh6dIdSLq6zdv4xs2ZHoi7Iefud4HXxtOF+SiEyEDZpk2QKWbqalecUYPqW9
+I7OW+XNn6kkmwB47CN0jJTJyM2ZYLKWh3ksAT0YpcrfqxsLrzcetNAf4FoXPJJ4wvtSZqNb8tc42
+F2syM6cEtleu4vPJRrQWX7I2B1vB62R4iOYaHXVkNAJbySikLl3qswznRuyGffqrdFJn/Qz8kKpQ
+4533Id3y42t5vESJrFkDv9GdQGpQwhUM8gd1Wnsi4RnhDj/TxHuViKBbWlk24cfiI5oJ8F9R3Obp
+mqlR8fGmb+sNZj2hvN6PhTt40agLCOtYcG8Khw12PRtH7XYBmZ7ablGzuRkPE1Zw6EFlihLFHgJ6
+F1s6j8KvrovqWnhL4btGSXaNgsoNSTbdDJz8KTU161tdlNkc/Vi4nkie1ep26V8SbZBduiB2drKJ
+UI/GddOKxIrzvvDqQ6cgl6btR9/EadtXspqSW5Na15JPbinF0ybE8jdw3GOarRDIX33VapaNjM5f
+wpG3OA0KDA4nZtLoDx+ktQ0OOAbWaFs1Q5WhiT6n0gJhH9CuhbOP11YwggL5BgkqhkiG9w0BBwGg
+ggLqBIIC5jCCAuIwggLeBgsqhkiG9w0BDAoBAqCCAqYwggKiMBwGCiqGSIb3DQEMAQMwDgQIUoyX
+VGIzfzoCAggABIICgEMMnAdRKTYakglE3mmLUOHkRO78/NegcGhpDpImSfsGloZpSXlCnGN8wRf8
+OJHXXLB7VS6uwzh8Mb0Q6gEctUHiVlYB2Pk0q2BFiv4aOZ63PNTCLQ5ADHc2NPggJYAkVhVG5iOG
+TbSbYiKYMz+hjbSb/ScQJVWhE89sf/RyjRd7IK4mRXyFBQIjYJAcOfYevGyW6DFjT4NjjaMONGNd
+zV3WKzj7wsD9h920OPKpF4VpM0rUPIWEYGpft3t7fQybnIRS2bDdbEDaSzoLg8JmP0pKlQA2KVHp
+mx52ahyEynnvxA9a81PnGeb+6KyJBYs9LCzm452x5nKaAdAtDNO4qftutKQO8T1nMNGJ4aaS3HX2
+UymhvxIuVSIOIX49f/uvB8LDsi4n2oI43noIBC1L+FPMbADmioP5cwBQ/IeetuLn+RQaaeR18CAF
+v0QlnXeJkfzOfgaDUGvl9U35jbsXSglWe0uCAKXd+fA6WCDfOqHEbESyXvZRh2Kbm/LJEqOJod6b
+B7d05Nf+KcUxdqlbf7Tu4qLBDWbSjXjEFJCdYbjb0BRH91r1uaNkLpB8C/VZuQ9wYbrVGFaOGt+W
+SseoBl815k0JEZC+uUSRuGXV7gUp1+WWxA/QYgHIr67FzwBTAyjeF8MOeUxhTh2gPPXe5dEJZaaZ
+toKxCNei9/KwGfxA98l9KwbejHaSYTRxdxDA6IIrH//KBZhaUA+ejd/nirSb5loBbcIqkGr3p74d
+4zonk2gyTUQzuvNKOpKSBKxmfUpBcjfCrF6islet1uR6YPXWP0YsrcKbxsXALgcQROIgkkrfTJYu
+U/PqAfd+BjoaV8pAMJg8zKA0QAsuzK8tpBExJTAjBgkqhkiG9w0BCRUxFgQU50qit3EXCRvUgf87
+IyT8dPGL3KAwMTAhMAkGBSsOAwIaBQAEFI8Oh3rMcbx/dW7as1rnLEHY16BYBAizzZqHhv23yAIC
+CAA=
+`
+
+const testPfxThumbprint = "E74AA2B77117091BD481FF3B2324FC74F18BDCA0"
+
+func getTestPfxFile(t *testing.T) string {
+	data, err := base64.StdEncoding.DecodeString(strings.Replace(testPfx, "\n", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "packer-test-pfx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestConfig_WindowsProvisioning(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	pfx := getTestPfxFile(t)
+	defer os.Remove(pfx)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	cfgmap := getDefaultTestConfig(f)
+	cfgmap["os_type"] = "Windows"
+	cfg, _, err := newConfig(cfgmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*cfg.EnableAutomaticUpdates {
+		t.Errorf("expected automatic updates to be enabled by default")
+	}
+
+	cfgmap["time_zone"] = "Pacific Standard Time"
+	cfgmap["enable_automatic_updates"] = false
+	cfgmap["stored_certificates"] = []map[string]interface{}{{"path": pfx, "password": "secret"}}
+	cfgmap["additional_unattend_content"] = []map[string]interface{}{{"setting": "AutoLogon", "content": "<AutoLogon/>"}}
+	cfg, _, err = newConfig(cfgmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cfg.EnableAutomaticUpdates {
+		t.Errorf("expected automatic updates to be disabled")
+	}
+	if c := cfg.StoredCertificates[0]; c.thumbprint != testPfxThumbprint || c.StoreName != "My" || c.StoreLocation != "LocalMachine" {
+		t.Errorf("unexpected stored certificate: %+v", c)
+	}
+	if u := cfg.AdditionalUnattendContent[0]; u.Pass != "oobeSystem" || u.Component != "Microsoft-Windows-Shell-Setup" {
+		t.Errorf("unexpected unattend content: %+v", u)
+	}
+
+	tcs := []struct {
+		cfgmod func(map[string]interface{})
+		err    bool
+	}{
+		{func(cfg map[string]interface{}) { cfg["os_type"] = "Linux" }, true},
+		{func(cfg map[string]interface{}) {
+			cfg["stored_certificates"] = []map[string]interface{}{{"path": pfx, "password": "wrong"}}
+		}, true},
+		{func(cfg map[string]interface{}) {
+			cfg["stored_certificates"] = []map[string]interface{}{{"path": pfx, "password": "secret", "store_location": "CurrentUser"}}
+		}, true},
+		{func(cfg map[string]interface{}) {
+			cfg["additional_unattend_content"] = []map[string]interface{}{{"setting": "Unknown", "content": "<x/>"}}
+		}, true},
+		{func(cfg map[string]interface{}) {
+			cfg["additional_unattend_content"] = []map[string]interface{}{{"setting": "AutoLogon"}}
+		}, true},
+		{func(cfg map[string]interface{}) {
+			cfg["additional_unattend_content"] = []map[string]interface{}{{"setting": "AutoLogon", "content_file": f}}
+		}, false},
+	}
+
+	for _, tc := range tcs {
+		cfgmap := getDefaultTestConfig(f)
+		cfgmap["os_type"] = "Windows"
+		cfgmap["stored_certificates"] = []map[string]interface{}{{"path": pfx, "password": "secret"}}
+		tc.cfgmod(cfgmap)
+		_, _, err := newConfig(cfgmap)
+		if (err != nil) != tc.err {
+			t.Fatalf("unexpected error value: %v", err)
+		}
+	}
+}
+
+func TestMarshalDeploymentRequest(t *testing.T) {
+	unattend, err := marshalUnattendContent([]UnattendContent{
+		{Pass: "oobeSystem", Component: "Microsoft-Windows-Shell-Setup", Setting: "AutoLogon", Content: "a"},
+		{Pass: "oobeSystem", Component: "Microsoft-Windows-Shell-Setup", Setting: "FirstLogonCommands", Content: "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role := vmutils.NewVMConfiguration("vm", "Small")
+	vmutils.ConfigureForWindows(&role, "vm", "packer", "P@ssw0rd", false, "UTC")
+	role.ConfigurationSets[0].AdditionalUnattendContent = unattend
+
+	data, err := marshalDeploymentRequest(role, vm.CreateDeploymentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<AdminPassword>P@ssw0rd</AdminPassword><EnableAutomaticUpdates>false</EnableAutomaticUpdates><TimeZone>UTC</TimeZone>"
+	if !strings.Contains(string(data), expected) {
+		t.Errorf("expected request to contain\n%s\ngot\n%s", expected, data)
+	}
+
+	expected = "<AdminUsername>packer</AdminUsername><AdditionalUnattendContent><Passes><UnattendPass><PassName>oobeSystem</PassName>" +
+		"<Components><UnattendComponent><ComponentName>Microsoft-Windows-Shell-Setup</ComponentName><ComponentSettings>" +
+		"<ComponentSetting><SettingName>AutoLogon</SettingName><Content>YQ==</Content></ComponentSetting>" +
+		"<ComponentSetting><SettingName>FirstLogonCommands</SettingName><Content>Yg==</Content></ComponentSetting>" +
+		"</ComponentSettings></UnattendComponent></Components></UnattendPass></Passes></AdditionalUnattendContent>"
+	if !strings.Contains(string(data), expected) {
+		t.Errorf("expected request to contain\n%s\ngot\n%s", expected, data)
+	}
+	if role.ConfigurationSets[0].AdditionalUnattendContent != unattend {
+		t.Errorf("role was modified")
+	}
+
+	vmutils.ConfigureForWindows(&role, "vm", "packer", "P@ssw0rd", true, "")
+	role.ConfigurationSets[0].AdditionalUnattendContent = ""
+	data, err = marshalDeploymentRequest(role, vm.CreateDeploymentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "false") || strings.Contains(string(data), "AdditionalUnattendContent") {
+		t.Errorf("unexpected request %s", data)
+	}
+}
+
+func TestValidateWindowsUserName(t *testing.T) {
+	tcs := []struct {
+		name string
+		err  bool
+	}{
+		{"packer", false},
+		{"Administrator", true},
+		{"guest", true},
+		{"packer.", true},
+		{"pack@er", true},
+		{strings.Repeat("p", 21), true},
+	}
+
+	for _, tc := range tcs {
+		if err := validateWindowsUserName(tc.name); (err != nil) != tc.err {
+			t.Errorf("unexpected error value for %q: %v", tc.name, err)
+		}
+	}
+}
+
+func TestValidateWindowsPassword(t *testing.T) {
+	tcs := []struct {
+		password string
+		err      bool
+	}{
+		{"Passw0rd", false},
+		{"passw0rd!", false},
+		{"Pa0!", true},
+		{"password", true},
+		{"Password", true},
+		{strings.Repeat("Pa0", 42), true},
+	}
+
+	for _, tc := range tcs {
+		if err := validateWindowsPassword(tc.password); (err != nil) != tc.err {
+			t.Errorf("unexpected error value for %q: %v", tc.password, err)
+		}
+	}
+}
+
+func TestConfig_WindowsCredentials(t *testing.T) {
+	f := getTempFile(t)
+	defer os.Remove(f)
+	log.SetOutput(testLogger{t}) // hide log if test is succes
+
+	cfgmap := getDefaultTestConfig(f)
+	cfgmap["os_type"] = "Windows"
+	for i := 0; i < 100; i++ {
+		cfg, _, err := newConfig(cfgmap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateWindowsPassword(cfg.tmpAdminPassword); err != nil {
+			t.Fatalf("generated password %q is invalid: %s", cfg.tmpAdminPassword, err)
+		}
+	}
+
+	cfgmap["username"] = "admin"
+	if _, _, err := newConfig(cfgmap); err == nil {
+		t.Errorf("expected reserved username to be rejected")
+	}
+
+	// the rules only apply to Windows
+	cfgmap["os_type"] = "Linux"
+	if _, _, err := newConfig(cfgmap); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
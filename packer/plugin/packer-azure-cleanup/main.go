@@ -0,0 +1,88 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+// packer-azure-cleanup deletes the temporary resources listed in the journal
+// of a failed or killed build.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi"
+)
+
+func main() {
+	var (
+		publishSettingsPath = flag.String("publish-settings", "", "path of the publish settings file, the one of the build if not given")
+		dryRun              = flag.Bool("dry-run", false, "only show what would be deleted")
+		verbose             = flag.Bool("verbose", false, "log the requests")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] journal.json...\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Deletes the resources listed in the journals of builds, a journal is removed")
+		fmt.Fprintln(os.Stderr, "when all its resources are deleted.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		if err := cleanup(path, *publishSettingsPath, *dryRun); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func cleanup(path, publishSettingsPath string, dryRun bool) error {
+	journal, err := azure.ReadJournal(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Resources of %s:\n", path)
+	for _, r := range journal.Resources {
+		fmt.Printf("  %s\n", r)
+	}
+	if dryRun {
+		fmt.Println("Dry run, nothing deleted.")
+		return nil
+	}
+
+	if publishSettingsPath == "" {
+		publishSettingsPath = journal.PublishSettingsPath
+	}
+	client, err := azure.ClientFromPublishSettings(publishSettingsPath, journal.SubscriptionName)
+	if err != nil {
+		return err
+	}
+
+	if err := journal.DeleteResources(client, func(r azure.JournalResource, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error deleting %s: %v\n", r, err)
+		} else {
+			fmt.Printf("Deleted %s\n", r)
+		}
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removing journal %s\n", path)
+	return journal.Remove()
+}
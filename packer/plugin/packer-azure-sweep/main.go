@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+// packer-azure-sweep deletes the temporary hosted services, disks and
+// provisioning containers that crashed or killed builds left behind, and on
+// request their VHDs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi"
+)
+
+// listFlag collects a flag that can be repeated or comma separated.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func main() {
+	var (
+		publishSettingsPath = flag.String("publish-settings", "", "path of the publish settings file (required)")
+		subscriptionName    = flag.String("subscription", "", "name of the subscription (required)")
+		minAge              = flag.Duration("min-age", 24*time.Hour, "minimum age of the resources to delete")
+		dryRun              = flag.Bool("dry-run", false, "only show what would be deleted")
+		verbose             = flag.Bool("verbose", false, "log the requests and the skipped resources")
+		config              azure.SweepConfig
+	)
+	flag.Var((*listFlag)(&config.Allowlist), "allow", "name pattern of resources to keep, can be repeated")
+	flag.BoolVar(&config.IncludeVhds, "include-vhds", false, "also delete PkrVM* VHDs that back no disk or image")
+	flag.Var((*listFlag)(&config.StorageAccounts), "storage-account", "storage account to search, all are searched if not given, can be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Deletes PkrSrv* hosted services, PkrVM* disks and packer-provision-* containers that are")
+		fmt.Fprintln(os.Stderr, "older than -min-age. With -include-vhds, PkrVM* VHDs that back no disk or image are")
+		fmt.Fprintln(os.Stderr, "deleted too, which includes the outputs of VHD-only builds that were not moved unless")
+		fmt.Fprintln(os.Stderr, "they are allowlisted.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *publishSettingsPath == "" || *subscriptionName == "" || flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+	config.MinAge = *minAge
+
+	client, err := azure.ClientFromPublishSettings(*publishSettingsPath, *subscriptionName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	resources, err := azure.FindOrphanedResources(client, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(resources) == 0 {
+		fmt.Println("No orphaned resources found.")
+		return
+	}
+
+	fmt.Printf("Orphaned resources older than %s:\n", config.MinAge)
+	for _, r := range resources {
+		fmt.Printf("  %s\n", r)
+	}
+	if *dryRun {
+		fmt.Println("Dry run, nothing deleted.")
+		return
+	}
+
+	failed := 0
+	for _, r := range resources {
+		fmt.Printf("Deleting %s %s...\n", r.Kind, r.Name)
+		if err := r.Delete(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error deleting %s %s: %v\n", r.Kind, r.Name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d resources could not be deleted.\n", failed, len(resources))
+		os.Exit(1)
+	}
+	fmt.Printf("Deleted %d resources.\n", len(resources))
+}
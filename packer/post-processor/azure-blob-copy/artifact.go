@@ -0,0 +1,42 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azureblobcopy
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+)
+
+const BuilderId = "Azure.ServiceManagement.BlobCopy"
+
+// BlobCopyArtifact lists the URLs of the copied blobs.
+type BlobCopyArtifact struct {
+	OSDisk    string
+	DataDisks []string
+}
+
+func (*BlobCopyArtifact) BuilderId() string { return BuilderId }
+func (*BlobCopyArtifact) Destroy() error    { return nil }
+func (*BlobCopyArtifact) Files() []string   { return nil }
+func (a *BlobCopyArtifact) Id() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(a.String())))
+}
+func (a *BlobCopyArtifact) State(name string) interface{} {
+	switch name {
+	case "osDisk":
+		return a.OSDisk
+	case "dataDisks":
+		return a.DataDisks
+	default:
+		return nil
+	}
+}
+func (a *BlobCopyArtifact) String() string {
+	d, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return string(d)
+}
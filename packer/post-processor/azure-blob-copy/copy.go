@@ -0,0 +1,150 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azureblobcopy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+const (
+	copyStatusPending = "pending"
+	copyStatusSuccess = "success"
+	copyStatusAborted = "aborted"
+	copyStatusFailed  = "failed"
+)
+
+var copyPollInterval = 15 * time.Second
+
+type copyStatus struct {
+	ID            string
+	Status        string
+	Description   string
+	BytesCopied   int64
+	BytesTotal    int64
+	ContentLength int64
+}
+
+// startBlobCopy starts a server-side asynchronous copy of sourceURL to
+// destinationURL. Both URLs need to carry a SAS that permits the operation.
+func startBlobCopy(destinationURL, sourceURL string) (string, error) {
+	req, err := http.NewRequest("PUT", destinationURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-ms-version", storage.DefaultAPIVersion)
+	req.Header.Set("x-ms-copy-source", sourceURL)
+	req.ContentLength = 0
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("unexpected status starting blob copy: %s %s", resp.Status, body)
+	}
+
+	copyID := resp.Header.Get("x-ms-copy-id")
+	if copyID == "" {
+		return "", fmt.Errorf("got empty copy id header")
+	}
+	return copyID, nil
+}
+
+func getCopyStatus(destinationURL string) (copyStatus, error) {
+	var status copyStatus
+
+	req, err := http.NewRequest("HEAD", destinationURL, nil)
+	if err != nil {
+		return status, err
+	}
+	req.Header.Set("x-ms-version", storage.DefaultAPIVersion)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("unexpected status retrieving blob properties: %s", resp.Status)
+	}
+
+	status.ID = resp.Header.Get("x-ms-copy-id")
+	status.Status = resp.Header.Get("x-ms-copy-status")
+	status.Description = resp.Header.Get("x-ms-copy-status-description")
+	status.ContentLength = resp.ContentLength
+	status.BytesCopied, status.BytesTotal, err = parseCopyProgress(resp.Header.Get("x-ms-copy-progress"))
+	return status, err
+}
+
+// parseCopyProgress parses the x-ms-copy-progress header, formatted as
+// <bytes copied>/<bytes total>.
+func parseCopyProgress(progress string) (int64, int64, error) {
+	if progress == "" {
+		return 0, 0, nil
+	}
+
+	parts := strings.Split(progress, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid copy progress %q", progress)
+	}
+	copied, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid copy progress %q: %v", progress, err)
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid copy progress %q: %v", progress, err)
+	}
+	return copied, total, nil
+}
+
+func waitForBlobCopy(ui packer.Ui, destinationURL, copyID string, timeout time.Duration) (copyStatus, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		status, err := getCopyStatus(destinationURL)
+		if err != nil {
+			return status, err
+		}
+		if status.ID != copyID {
+			return status, fmt.Errorf("copy id %q does not match expected copy id %q, another copy was started", status.ID, copyID)
+		}
+
+		switch status.Status {
+		case copyStatusSuccess:
+			return status, nil
+		case copyStatusPending:
+			if status.BytesTotal > 0 {
+				ui.Message(fmt.Sprintf("Copy progress: %d%% (%d/%d bytes)",
+					status.BytesCopied*100/status.BytesTotal, status.BytesCopied, status.BytesTotal))
+			}
+		case copyStatusAborted:
+			return status, fmt.Errorf("blob copy was aborted: %s", status.Description)
+		case copyStatusFailed:
+			return status, fmt.Errorf("blob copy failed: %s", status.Description)
+		default:
+			return status, fmt.Errorf("unhandled blob copy status %q", status.Status)
+		}
+
+		if time.Now().After(deadline) {
+			return status, fmt.Errorf("blob copy did not complete within %v", timeout)
+		}
+		log.Printf("Waiting for another %v...", copyPollInterval)
+		time.Sleep(copyPollInterval)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azureblobcopy
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	azureCommon "github.com/Azure/packer-azure/packer/builder/azure/common"
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+	"github.com/Azure/packer-azure/packer/post-processor/azure-sm-vhdonly"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/storage"
+
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/helper/config"
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+var _ packer.PostProcessor = &PostProcessor{}
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	StorageAccount    string        `mapstructure:"destination_storage_account"`
+	StorageAccountKey string        `mapstructure:"destination_storage_account_key"`
+	SASToken          string        `mapstructure:"destination_sas_token"`
+	Container         string        `mapstructure:"destination_container"`
+	BlobPrefix        string        `mapstructure:"destination_blob_prefix"`
+	CopyTimeout       time.Duration `mapstructure:"copy_timeout"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.CopyTimeout == 0 {
+		p.config.CopyTimeout = 4 * time.Hour
+	}
+	p.config.SASToken = strings.TrimPrefix(p.config.SASToken, "?")
+
+	var errs *packer.MultiError
+
+	if p.config.StorageAccount == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("destination_storage_account must be specified"))
+	}
+	if p.config.Container == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("destination_container must be specified"))
+	}
+	if (p.config.StorageAccountKey == "") == (p.config.SASToken == "") {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("One and only one of destination_storage_account_key or destination_sas_token has to be specified"))
+	}
+
+	log.Println(common.ScrubConfig(p.config, p.config.StorageAccountKey, p.config.SASToken))
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	ui.Say("Validating artifact")
+	if artifact.BuilderId() != azure.BuilderId && artifact.BuilderId() != azuresmvhdonly.BuilderID {
+		return nil, false, fmt.Errorf(
+			"Unknown artifact type: %s\nCan only copy blobs of Azure builder artifacts (%s) or VHD only artifacts (%s).",
+			artifact.BuilderId(), azure.BuilderId, azuresmvhdonly.BuilderID)
+	}
+
+	ui.Message("Creating Azure Service Management client...")
+	client, err := azure.ClientFromArtifact(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ui.Message("Retrieving VHD blobs...")
+	blobs, err := azuresmvhdonly.BlobsFromArtifact(client, artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	result := &BlobCopyArtifact{
+		DataDisks: make([]string, len(blobs.DataDisks)),
+	}
+
+	if result.OSDisk, err = p.copyBlob(ui, client, blobs.OSDisk); err != nil {
+		return nil, false, err
+	}
+	for i, d := range blobs.DataDisks {
+		if result.DataDisks[i], err = p.copyBlob(ui, client, d); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return result, true, nil
+}
+
+// copyBlob copies a single blob to the destination container and returns the
+// destination URL.
+func (p *PostProcessor) copyBlob(ui packer.Ui, client management.Client, sourceURL string) (string, error) {
+	errorMsg := "Error copying blob %s: %v"
+
+	source, err := azureCommon.ParseBlobURL(sourceURL)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, sourceURL, err)
+	}
+	destination := azureCommon.BlobURL{
+		StorageAccount: p.config.StorageAccount,
+		EndpointSuffix: source.EndpointSuffix,
+		Container:      p.config.Container,
+		Blob:           p.config.BlobPrefix + path.Base(source.Blob),
+	}
+
+	sourceClient, err := azure.StorageClientForBlob(client, source)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, sourceURL, err)
+	}
+	sourceBlobService := sourceClient.GetBlobService()
+	sourceProperties, err := sourceBlobService.GetBlobProperties(source.Container, source.Blob)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, sourceURL, err)
+	}
+
+	expiry := time.Now().Add(p.config.CopyTimeout)
+	sourceSAS, err := sourceBlobService.GetBlobSASURI(source.Container, source.Blob, expiry, "r")
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, sourceURL, err)
+	}
+	destinationSAS, err := p.destinationSASURL(destination, expiry)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, sourceURL, err)
+	}
+
+	ui.Say(fmt.Sprintf("Copying %s to %s...", sourceURL, destination.URL()))
+	copyID, err := startBlobCopy(destinationSAS, sourceSAS)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, sourceURL, err)
+	}
+
+	status, err := waitForBlobCopy(ui, destinationSAS, copyID, p.config.CopyTimeout)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, sourceURL, err)
+	}
+
+	if status.ContentLength != sourceProperties.ContentLength {
+		return "", fmt.Errorf(errorMsg, sourceURL,
+			fmt.Errorf("destination length %d does not match source length %d", status.ContentLength, sourceProperties.ContentLength))
+	}
+	ui.Message(fmt.Sprintf("Copied %d bytes", status.ContentLength))
+
+	return destination.URL(), nil
+}
+
+// destinationSASURL returns a URL for the destination blob that allows
+// writing to it, either using the configured SAS token or a SAS created from
+// the destination account key.
+func (p *PostProcessor) destinationSASURL(destination azureCommon.BlobURL, expiry time.Time) (string, error) {
+	if p.config.SASToken != "" {
+		return destination.URL() + "?" + p.config.SASToken, nil
+	}
+
+	client, err := storage.NewClient(destination.StorageAccount, p.config.StorageAccountKey,
+		destination.EndpointSuffix, storage.DefaultAPIVersion, true)
+	if err != nil {
+		return "", err
+	}
+	blobService := client.GetBlobService()
+	if _, err := blobService.CreateContainerIfNotExists(destination.Container, storage.ContainerAccessTypePrivate); err != nil {
+		return "", err
+	}
+	return blobService.GetBlobSASURI(destination.Container, destination.Blob, expiry, "rw")
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azureblobcopy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/post-processor/internal/testui"
+
+	"github.com/mitchellh/packer/packer"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func defaultConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"destination_storage_account":     "distsa",
+		"destination_storage_account_key": "a2V5",
+		"destination_container":           "images",
+	}
+}
+
+func (s *MySuite) Test_Configure(c *C) {
+	sut := PostProcessor{}
+	c.Assert(sut.Configure(defaultConfig()), IsNil)
+	c.Check(sut.config.CopyTimeout, Equals, 4*time.Hour)
+
+	for _, tc := range []func(map[string]interface{}){
+		func(m map[string]interface{}) { delete(m, "destination_storage_account") },
+		func(m map[string]interface{}) { delete(m, "destination_container") },
+		func(m map[string]interface{}) { delete(m, "destination_storage_account_key") },
+		func(m map[string]interface{}) { m["destination_sas_token"] = "sv=x&sig=y" },
+	} {
+		m := defaultConfig()
+		tc(m)
+		sut := PostProcessor{}
+		c.Check(sut.Configure(m), NotNil)
+	}
+
+	m := defaultConfig()
+	delete(m, "destination_storage_account_key")
+	m["destination_sas_token"] = "?sv=x&sig=y"
+	sut = PostProcessor{}
+	c.Assert(sut.Configure(m), IsNil)
+	c.Check(sut.config.SASToken, Equals, "sv=x&sig=y")
+}
+
+func (s *MySuite) Test_BuilderId(c *C) {
+	a := packer.MockArtifact{BuilderIdValue: "bla"}
+
+	sut := PostProcessor{}
+	_, _, err := sut.PostProcess(testui.New(c), &a)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "Unknown artifact type: bla\n.*")
+}
+
+func (s *MySuite) Test_ParseCopyProgress(c *C) {
+	copied, total, err := parseCopyProgress("1024/4096")
+	c.Assert(err, IsNil)
+	c.Check(copied, Equals, int64(1024))
+	c.Check(total, Equals, int64(4096))
+
+	copied, total, err = parseCopyProgress("")
+	c.Assert(err, IsNil)
+	c.Check(copied, Equals, int64(0))
+	c.Check(total, Equals, int64(0))
+
+	for _, p := range []string{"1024", "a/b", "1/2/3"} {
+		_, _, err = parseCopyProgress(p)
+		c.Check(err, NotNil)
+	}
+}
+
+func (s *MySuite) Test_CopyBlob(c *C) {
+	copyPollInterval = time.Millisecond
+	polls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			c.Check(r.Header.Get("x-ms-copy-source"), Equals, "https://source/vhds/disk.vhd?sig=r")
+			w.Header().Set("x-ms-copy-id", "copy1")
+			w.WriteHeader(http.StatusAccepted)
+		case "HEAD":
+			polls++
+			w.Header().Set("x-ms-copy-id", "copy1")
+			if polls < 3 {
+				w.Header().Set("x-ms-copy-status", copyStatusPending)
+				w.Header().Set("x-ms-copy-progress", "512/1024")
+			} else {
+				w.Header().Set("x-ms-copy-status", copyStatusSuccess)
+				w.Header().Set("x-ms-copy-progress", "1024/1024")
+			}
+			w.Header().Set("Content-Length", "1024")
+		}
+	}))
+	defer ts.Close()
+
+	copyID, err := startBlobCopy(ts.URL+"/images/disk.vhd?sig=w", "https://source/vhds/disk.vhd?sig=r")
+	c.Assert(err, IsNil)
+	c.Check(copyID, Equals, "copy1")
+
+	status, err := waitForBlobCopy(testui.New(c), ts.URL+"/images/disk.vhd?sig=w", copyID, time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(polls, Equals, 3)
+	c.Check(status.ContentLength, Equals, int64(1024))
+
+	_, err = waitForBlobCopy(testui.New(c), ts.URL+"/images/disk.vhd?sig=w", "copy2", time.Minute)
+	c.Check(err, NotNil)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azuremanifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+	"github.com/Azure/packer-azure/packer/post-processor/azure-sm-vhdonly"
+
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/helper/config"
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+var _ packer.PostProcessor = &PostProcessor{}
+
+const defaultOutput = "azure-manifest.json"
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	Output string `mapstructure:"output"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+// Manifest is the content of the manifest file, every build appends an
+// entry to Builds.
+type Manifest struct {
+	Builds []Build `json:"builds"`
+}
+
+// Build records what an image was built from.
+type Build struct {
+	PackerBuildName          string            `json:"packer_build_name"`
+	ImageName                string            `json:"image_name"`
+	ImageLabel               string            `json:"image_label"`
+	Location                 string            `json:"location"`
+	OSVhd                    string            `json:"os_vhd"`
+	DataVhds                 []string          `json:"data_vhds"`
+	SourceImageName          string            `json:"source_image_name"`
+	SourceImagePublishedDate string            `json:"source_image_published_date"`
+	InstanceSize             string            `json:"instance_size"`
+	BuildStartTime           string            `json:"build_start_time"`
+	BuildEndTime             string            `json:"build_end_time"`
+	UserVariables            map[string]string `json:"user_variables"`
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.Output == "" {
+		p.config.Output = defaultOutput
+	}
+
+	log.Println(common.ScrubConfig(p.config))
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	ui.Say("Validating artifact")
+	if artifact.BuilderId() != azure.BuilderId && artifact.BuilderId() != azuresmvhdonly.BuilderID {
+		return nil, false, fmt.Errorf(
+			"Unknown artifact type: %s\nCan only write manifests for Azure builder artifacts (%s) or VHD only artifacts (%s).",
+			artifact.BuilderId(), azure.BuilderId, azuresmvhdonly.BuilderID)
+	}
+
+	ui.Message("Creating Azure Service Management client...")
+	client, err := azure.ClientFromArtifact(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ui.Message("Retrieving VHD blobs...")
+	blobs, err := azuresmvhdonly.BlobsFromArtifact(client, artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	build := p.build(artifact, blobs)
+
+	ui.Say(fmt.Sprintf("Adding build to manifest %s...", p.config.Output))
+	if err := appendToManifest(p.config.Output, build); err != nil {
+		return nil, false, fmt.Errorf("Error writing manifest %s: %v", p.config.Output, err)
+	}
+
+	return artifact, true, nil
+}
+
+// build returns the manifest entry of artifact, VHD only artifacts carry the
+// state of the builder artifact they were made from.
+func (p *PostProcessor) build(artifact packer.Artifact, blobs azuresmvhdonly.VMBlobListArtifact) Build {
+	return Build{
+		PackerBuildName:          p.config.PackerBuildName,
+		ImageName:                stateString(artifact, "imageName"),
+		ImageLabel:               stateString(artifact, "imageLabel"),
+		Location:                 stateString(artifact, "location"),
+		OSVhd:                    blobs.OSDisk,
+		DataVhds:                 blobs.DataDisks,
+		SourceImageName:          stateString(artifact, "sourceImageName"),
+		SourceImagePublishedDate: stateString(artifact, "sourceImagePublishedDate"),
+		InstanceSize:             stateString(artifact, "instanceSize"),
+		BuildStartTime:           stateString(artifact, "buildStartTime"),
+		BuildEndTime:             stateString(artifact, "buildEndTime"),
+		UserVariables:            p.config.PackerUserVars,
+	}
+}
+
+// appendToManifest adds build to the manifest at path, the file is created
+// if it does not exist.
+func appendToManifest(path string, build Build) error {
+	var manifest Manifest
+
+	d, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && len(d) > 0 {
+		if err := json.Unmarshal(d, &manifest); err != nil {
+			return fmt.Errorf("existing manifest is not valid: %v", err)
+		}
+	}
+
+	manifest.Builds = append(manifest.Builds, build)
+
+	d, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
+
+func stateString(artifact packer.Artifact, name string) string {
+	if s, ok := artifact.State(name).(string); ok {
+		return s
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azuremanifest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/packer-azure/packer/post-processor/azure-sm-vhdonly"
+	"github.com/Azure/packer-azure/packer/post-processor/internal/testui"
+
+	"github.com/mitchellh/packer/packer"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func (s *MySuite) Test_Configure(c *C) {
+	sut := PostProcessor{}
+	c.Assert(sut.Configure(map[string]interface{}{}), IsNil)
+	c.Check(sut.config.Output, Equals, defaultOutput)
+}
+
+func (s *MySuite) Test_BuilderId(c *C) {
+	a := packer.MockArtifact{BuilderIdValue: "bla"}
+
+	sut := PostProcessor{}
+	_, _, err := sut.PostProcess(testui.New(c), &a)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "Unknown artifact type: bla\n.*")
+}
+
+func (s *MySuite) Test_AppendToManifest(c *C) {
+	path := filepath.Join(c.MkDir(), "manifest.json")
+
+	c.Assert(appendToManifest(path, Build{ImageName: "image1", UserVariables: map[string]string{"version": "1"}}), IsNil)
+	c.Assert(appendToManifest(path, Build{ImageName: "image2", DataVhds: []string{"https://sa.blob.core.windows.net/vhds/data.vhd"}}), IsNil)
+
+	d, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	var manifest Manifest
+	c.Assert(json.Unmarshal(d, &manifest), IsNil)
+	c.Assert(manifest.Builds, HasLen, 2)
+	c.Check(manifest.Builds[0].ImageName, Equals, "image1")
+	c.Check(manifest.Builds[0].UserVariables["version"], Equals, "1")
+	c.Check(manifest.Builds[1].ImageName, Equals, "image2")
+	c.Check(manifest.Builds[1].DataVhds, DeepEquals, []string{"https://sa.blob.core.windows.net/vhds/data.vhd"})
+
+	c.Assert(ioutil.WriteFile(path, []byte("not json"), 0644), IsNil)
+	c.Check(appendToManifest(path, Build{}), ErrorMatches, "existing manifest is not valid: .*")
+}
+
+func (s *MySuite) Test_BuildOfVhdOnlyArtifact(c *C) {
+	builderArtifact := packer.MockArtifact{StateValues: map[string]interface{}{
+		"publishSettingsPath":      "/path/to/settings",
+		"subscriptionID":           "subscription",
+		"imageName":                "image",
+		"imageLabel":               "label",
+		"location":                 "West US",
+		"sourceImageName":          "source",
+		"sourceImagePublishedDate": "2016-01-02T03:04:05Z",
+		"instanceSize":             "Small",
+		"buildStartTime":           "2016-02-01T10:00:00Z",
+		"buildEndTime":             "2016-02-01T11:00:00Z",
+	}}
+	vhdOnly := azuresmvhdonly.NewVMBlobListArtifact(&builderArtifact,
+		"https://sa.blob.core.windows.net/images/os.vhd",
+		[]string{"https://sa.blob.core.windows.net/images/data.vhd"})
+
+	blobs, err := azuresmvhdonly.BlobsFromArtifact(nil, vhdOnly)
+	c.Assert(err, IsNil)
+
+	sut := PostProcessor{}
+	sut.config.PackerBuildName = "build"
+	c.Check(sut.build(vhdOnly, blobs), DeepEquals, Build{
+		PackerBuildName:          "build",
+		ImageName:                "image",
+		ImageLabel:               "label",
+		Location:                 "West US",
+		OSVhd:                    "https://sa.blob.core.windows.net/images/os.vhd",
+		DataVhds:                 []string{"https://sa.blob.core.windows.net/images/data.vhd"},
+		SourceImageName:          "source",
+		SourceImagePublishedDate: "2016-01-02T03:04:05Z",
+		InstanceSize:             "Small",
+		BuildStartTime:           "2016-02-01T10:00:00Z",
+		BuildEndTime:             "2016-02-01T11:00:00Z",
+	})
+	c.Check(vhdOnly.State("publishSettingsPath"), Equals, "/path/to/settings")
+	c.Check(vhdOnly.State("subscriptionID"), Equals, "subscription")
+}
+
+func (s *MySuite) Test_StateString(c *C) {
+	a := packer.MockArtifact{StateValues: map[string]interface{}{"location": "West US", "number": 1}}
+	c.Check(stateString(&a, "location"), Equals, "West US")
+	c.Check(stateString(&a, "number"), Equals, "")
+	c.Check(stateString(&a, "missing"), Equals, "")
+}
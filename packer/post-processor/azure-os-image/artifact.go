@@ -0,0 +1,64 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azureosimage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+)
+
+const BuilderId = "Azure.ServiceManagement.OSImage"
+
+// OSImageArtifact is an OS image registered from the OS VHD of a build.
+type OSImageArtifact struct {
+	Name      string
+	Label     string
+	MediaLink string
+	OS        string
+
+	publishSettingsPath string
+	subscriptionID      string
+}
+
+func (*OSImageArtifact) BuilderId() string { return BuilderId }
+func (*OSImageArtifact) Files() []string   { return nil }
+func (a *OSImageArtifact) Id() string      { return a.Name }
+
+// Destroy removes the OS image, the VHD is kept.
+func (a *OSImageArtifact) Destroy() error {
+	client, err := azure.ClientFromArtifact(a)
+	if err != nil {
+		return err
+	}
+	return azure.DeleteOSImage(client, a.Name, false)
+}
+
+func (a *OSImageArtifact) State(name string) interface{} {
+	switch name {
+	case "osImageName":
+		return a.Name
+	case "osImageLabel":
+		return a.Label
+	case "osDisk":
+		return a.MediaLink
+	case "dataDisks":
+		return []string{}
+	case "publishSettingsPath":
+		return a.publishSettingsPath
+	case "subscriptionID":
+		return a.subscriptionID
+	default:
+		return nil
+	}
+}
+
+func (a *OSImageArtifact) String() string {
+	d, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return string(d)
+}
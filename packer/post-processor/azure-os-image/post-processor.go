@@ -0,0 +1,122 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azureosimage
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	azureCommon "github.com/Azure/packer-azure/packer/builder/azure/common"
+	"github.com/Azure/packer-azure/packer/builder/azure/common/constants"
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+	"github.com/Azure/packer-azure/packer/post-processor/azure-sm-vhdonly"
+
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/helper/config"
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+var _ packer.PostProcessor = &PostProcessor{}
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	ImageName   string `mapstructure:"image_name"`
+	Label       string `mapstructure:"label"`
+	Family      string `mapstructure:"family"`
+	Description string `mapstructure:"description"`
+	OSType      string `mapstructure:"os_type"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.Description == "" {
+		p.config.Description = "packer made image"
+	}
+
+	var errs *packer.MultiError
+
+	if !(p.config.OSType == constants.Target_Linux || p.config.OSType == constants.Target_Windows) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("os_type is not valid, must be one of: %s, %s", constants.Target_Windows, constants.Target_Linux))
+	}
+
+	log.Println(common.ScrubConfig(p.config))
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	ui.Say("Validating artifact")
+	if artifact.BuilderId() != azuresmvhdonly.BuilderID {
+		return nil, false, fmt.Errorf(
+			"Unknown artifact type: %s\nCan only register OS images from VHD only artifacts (%s), use the azure-sm-vhdonly post-processor first.",
+			artifact.BuilderId(), azuresmvhdonly.BuilderID)
+	}
+
+	ui.Message("Creating Azure Service Management client...")
+	client, err := azure.ClientFromArtifact(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ui.Message("Retrieving VHD blobs...")
+	blobs, err := azuresmvhdonly.BlobsFromArtifact(client, artifact)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := azureCommon.ParseBlobURL(blobs.OSDisk); err != nil {
+		return nil, false, fmt.Errorf("Invalid OS disk URL %q: %v", blobs.OSDisk, err)
+	}
+
+	name := p.config.ImageName
+	if name == "" {
+		name = strings.TrimSuffix(path.Base(blobs.OSDisk), ".vhd")
+	}
+	label := p.config.Label
+	if label == "" {
+		label = name
+	}
+
+	ui.Say(fmt.Sprintf("Registering OS image %q from %s...", name, blobs.OSDisk))
+	if err := azure.RegisterOSImage(client, azure.OSImageParameters{
+		Label:       label,
+		MediaLink:   blobs.OSDisk,
+		Name:        name,
+		OS:          p.config.OSType,
+		Description: p.config.Description,
+		ImageFamily: p.config.Family,
+	}); err != nil {
+		return nil, false, fmt.Errorf("Error registering OS image: %v", err)
+	}
+
+	return &OSImageArtifact{
+		Name:      name,
+		Label:     label,
+		MediaLink: blobs.OSDisk,
+		OS:        p.config.OSType,
+
+		publishSettingsPath: artifact.State("publishSettingsPath").(string),
+		subscriptionID:      artifact.State("subscriptionID").(string),
+	}, true, nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azureosimage
+
+import (
+	"testing"
+
+	"github.com/Azure/packer-azure/packer/post-processor/internal/testui"
+
+	"github.com/mitchellh/packer/packer"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func (s *MySuite) Test_Configure(c *C) {
+	sut := PostProcessor{}
+	c.Assert(sut.Configure(map[string]interface{}{"os_type": "Linux", "family": "Ubuntu"}), IsNil)
+	c.Check(sut.config.Description, Equals, "packer made image")
+	c.Check(sut.config.Family, Equals, "Ubuntu")
+
+	sut = PostProcessor{}
+	c.Check(sut.Configure(map[string]interface{}{}), NotNil)
+	sut = PostProcessor{}
+	c.Check(sut.Configure(map[string]interface{}{"os_type": "Solaris"}), NotNil)
+}
+
+func (s *MySuite) Test_BuilderId(c *C) {
+	a := packer.MockArtifact{BuilderIdValue: "Azure.ServiceManagement.VMImage"}
+
+	sut := PostProcessor{}
+	_, _, err := sut.PostProcess(testui.New(c), &a)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "Unknown artifact type: Azure.ServiceManagement.VMImage\n.*")
+}
+
+func (s *MySuite) Test_ArtifactState(c *C) {
+	a := OSImageArtifact{
+		Name:                "image",
+		MediaLink:           "https://sa.blob.core.windows.net/vhds/image.vhd",
+		publishSettingsPath: "publishSettingsPath",
+		subscriptionID:      "subscriptionID",
+	}
+	c.Check(a.Id(), Equals, "image")
+	c.Check(a.State("osDisk"), Equals, "https://sa.blob.core.windows.net/vhds/image.vhd")
+	c.Check(a.State("publishSettingsPath"), Equals, "publishSettingsPath")
+	c.Check(a.State("subscriptionID"), Equals, "subscriptionID")
+}
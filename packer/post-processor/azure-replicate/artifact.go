@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurereplicate
+
+import (
+	"encoding/json"
+	"fmt"
+
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+)
+
+const BuilderId = "Azure.ServiceManagement.Replicate"
+
+// ReplicatedImageArtifact is an image that was replicated to other regions.
+type ReplicatedImageArtifact struct {
+	Name    string
+	Kind    string
+	Regions []string
+	Sharing string
+
+	publishSettingsPath string
+	subscriptionID      string
+}
+
+func (*ReplicatedImageArtifact) BuilderId() string { return BuilderId }
+func (*ReplicatedImageArtifact) Files() []string   { return nil }
+func (a *ReplicatedImageArtifact) Id() string      { return a.Name }
+
+// Destroy removes the replicas of the image, the image itself is kept.
+func (a *ReplicatedImageArtifact) Destroy() error {
+	client, err := azure.ClientFromArtifactWithAPIVersion(a, replicationAPIVersion)
+	if err != nil {
+		return err
+	}
+	return unreplicate(client, a.Kind, a.Name)
+}
+
+func (a *ReplicatedImageArtifact) State(name string) interface{} {
+	switch name {
+	case "imageName":
+		return a.Name
+	case "regions":
+		return a.Regions
+	case "sharing":
+		return a.Sharing
+	case "publishSettingsPath":
+		return a.publishSettingsPath
+	case "subscriptionID":
+		return a.subscriptionID
+	default:
+		return nil
+	}
+}
+
+func (a *ReplicatedImageArtifact) String() string {
+	d, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return string(d)
+}
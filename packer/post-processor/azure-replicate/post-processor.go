@@ -0,0 +1,140 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurereplicate
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+	"github.com/Azure/packer-azure/packer/post-processor/azure-os-image"
+
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/helper/config"
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+var _ packer.PostProcessor = &PostProcessor{}
+
+// Images are shared privately. The share API only knows the private, public
+// and MSDN permissions, it cannot share an image with a list of
+// subscriptions.
+const sharePermissionPrivate = "Private"
+
+var replicationPollInterval = 30 * time.Second
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	Regions            []string      `mapstructure:"regions"`
+	Offer              string        `mapstructure:"offer"`
+	Sku                string        `mapstructure:"sku"`
+	Version            string        `mapstructure:"version"`
+	ShareSubscriptions []string      `mapstructure:"share_subscriptions"`
+	ReplicationTimeout time.Duration `mapstructure:"replication_timeout"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.ReplicationTimeout == 0 {
+		p.config.ReplicationTimeout = 2 * time.Hour
+	}
+
+	var errs *packer.MultiError
+
+	if len(p.config.Regions) == 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("regions must be specified"))
+	}
+	if p.config.Offer == "" || p.config.Sku == "" || p.config.Version == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("offer, sku and version must be specified"))
+	}
+	if len(p.config.ShareSubscriptions) > 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("share_subscriptions is not supported by the Service Management API, images can only be shared privately"))
+	}
+
+	log.Println(common.ScrubConfig(p.config))
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	ui.Say("Validating artifact")
+	var kind, name string
+	switch artifact.BuilderId() {
+	case azure.BuilderId:
+		kind, name = imageKindVM, artifact.Id()
+	case azureosimage.BuilderId:
+		kind, name = imageKindOS, artifact.Id()
+	default:
+		return nil, false, fmt.Errorf(
+			"Unknown artifact type: %s\nCan only replicate Azure builder artifacts (%s) or OS image artifacts (%s).",
+			artifact.BuilderId(), azure.BuilderId, azureosimage.BuilderId)
+	}
+
+	ui.Message("Creating Azure Service Management client...")
+	client, err := azure.ClientFromArtifactWithAPIVersion(artifact, replicationAPIVersion)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ui.Say(fmt.Sprintf("Replicating image %q to %s...", name, strings.Join(p.config.Regions, ", ")))
+	if err := replicate(client, kind, name, replicationInput{
+		TargetLocations: p.config.Regions,
+		Offer:           p.config.Offer,
+		Sku:             p.config.Sku,
+		Version:         p.config.Version,
+	}); err != nil {
+		return nil, false, fmt.Errorf("Error replicating image: %v", err)
+	}
+
+	deadline := time.Now().Add(p.config.ReplicationTimeout)
+	for {
+		progress, err := getReplicationProgress(client, kind, name)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error retrieving replication progress: %v", err)
+		}
+		ui.Message(fmt.Sprintf("Replication progress: %s", progress))
+		if progress.complete(p.config.Regions) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, false, fmt.Errorf("Replication did not complete within %v", p.config.ReplicationTimeout)
+		}
+		time.Sleep(replicationPollInterval)
+	}
+
+	ui.Say("Setting image sharing to private...")
+	if err := share(client, kind, name, sharePermissionPrivate); err != nil {
+		return nil, false, fmt.Errorf("Error sharing image: %v", err)
+	}
+
+	return &ReplicatedImageArtifact{
+		Name:    name,
+		Kind:    kind,
+		Regions: p.config.Regions,
+		Sharing: sharePermissionPrivate,
+
+		publishSettingsPath: artifact.State("publishSettingsPath").(string),
+		subscriptionID:      artifact.State("subscriptionID").(string),
+	}, true, nil
+}
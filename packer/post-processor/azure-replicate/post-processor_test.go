@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurereplicate
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/Azure/packer-azure/packer/post-processor/internal/testui"
+
+	"github.com/mitchellh/packer/packer"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func defaultConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"regions": []string{"West US", "East US"},
+		"offer":   "MyOffer",
+		"sku":     "MySku",
+		"version": "1.0.0",
+	}
+}
+
+func (s *MySuite) Test_Configure(c *C) {
+	sut := PostProcessor{}
+	c.Assert(sut.Configure(defaultConfig()), IsNil)
+	c.Check(sut.config.ReplicationTimeout, Equals, 2*time.Hour)
+
+	for _, tc := range []func(map[string]interface{}){
+		func(m map[string]interface{}) { delete(m, "regions") },
+		func(m map[string]interface{}) { delete(m, "sku") },
+	} {
+		m := defaultConfig()
+		tc(m)
+		sut := PostProcessor{}
+		c.Check(sut.Configure(m), NotNil)
+	}
+
+	m := defaultConfig()
+	m["share_subscriptions"] = []string{"00000000-0000-0000-0000-000000000000"}
+	sut = PostProcessor{}
+	c.Check(sut.Configure(m), ErrorMatches, "(?s).*share_subscriptions is not supported by the Service Management API.*")
+}
+
+func (s *MySuite) Test_BuilderId(c *C) {
+	a := packer.MockArtifact{BuilderIdValue: "bla"}
+
+	sut := PostProcessor{}
+	_, _, err := sut.PostProcess(testui.New(c), &a)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "Unknown artifact type: bla\n.*")
+}
+
+func (s *MySuite) Test_ReplicationInput(c *C) {
+	d, err := xml.Marshal(replicationInput{
+		TargetLocations: []string{"West US", "East US"},
+		Offer:           "MyOffer",
+		Sku:             "MySku",
+		Version:         "1.0.0",
+	})
+	c.Assert(err, IsNil)
+	c.Check(string(d), Equals, `<ReplicationInput xmlns="http://schemas.microsoft.com/windowsazure">`+
+		`<TargetLocations><Region>West US</Region><Region>East US</Region></TargetLocations>`+
+		`<ComputeImageAttributes><Offer>MyOffer</Offer><Sku>MySku</Sku><Version>1.0.0</Version></ComputeImageAttributes>`+
+		`</ReplicationInput>`)
+}
+
+func (s *MySuite) Test_ReplicationProgress(c *C) {
+	progress, err := parseReplicationProgress([]byte(`<VMImageDetails xmlns="http://schemas.microsoft.com/windowsazure">
+  <Name>image</Name>
+  <ReplicationProgress>
+    <ReplicationProgressElement><Location>West US</Location><Progress>100</Progress></ReplicationProgressElement>
+    <ReplicationProgressElement><Location>East US</Location><Progress>40</Progress></ReplicationProgressElement>
+  </ReplicationProgress>
+</VMImageDetails>`))
+	c.Assert(err, IsNil)
+	c.Check(progress.String(), Equals, "East US 40%, West US 100%")
+	c.Check(progress.complete([]string{"West US"}), Equals, true)
+	c.Check(progress.complete([]string{"West US", "East US"}), Equals, false)
+	c.Check(progress.complete([]string{"North Europe"}), Equals, false)
+
+	_, err = parseReplicationProgress([]byte(`<OSImageDetails><ReplicationProgress><ReplicationProgressElement><Location>West US</Location><Progress>x</Progress></ReplicationProgressElement></ReplicationProgress></OSImageDetails>`))
+	c.Check(err, NotNil)
+}
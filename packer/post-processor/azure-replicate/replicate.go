@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurereplicate
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+)
+
+// The replication operations are not part of the SDK and need a newer API
+// version than the SDK default.
+const (
+	replicationAPIVersion = "2015-04-01"
+
+	imageKindOS = "images"
+	imageKindVM = "vmimages"
+
+	replicateURL   = "services/%s/%s/replicate"
+	unreplicateURL = "services/%s/%s/unreplicate"
+	detailsURL     = "services/%s/%s/details"
+	shareURL       = "services/%s/%s/share?permission=%s"
+)
+
+type replicationInput struct {
+	XMLName         xml.Name `xml:"http://schemas.microsoft.com/windowsazure ReplicationInput"`
+	TargetLocations []string `xml:"TargetLocations>Region"`
+	Offer           string   `xml:"ComputeImageAttributes>Offer"`
+	Sku             string   `xml:"ComputeImageAttributes>Sku"`
+	Version         string   `xml:"ComputeImageAttributes>Version"`
+}
+
+// replicationProgress is the progress in percent per location.
+type replicationProgress map[string]int
+
+type imageDetails struct {
+	ReplicationProgress []struct {
+		Location string
+		Progress string
+	} `xml:"ReplicationProgress>ReplicationProgressElement"`
+}
+
+func replicate(client management.Client, kind, name string, input replicationInput) error {
+	data, err := xml.Marshal(input)
+	if err != nil {
+		return err
+	}
+	return retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return client.SendAzurePutRequest(fmt.Sprintf(replicateURL, kind, name), "text/xml", data)
+	})
+}
+
+func unreplicate(client management.Client, kind, name string) error {
+	return retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return client.SendAzurePutRequest(fmt.Sprintf(unreplicateURL, kind, name), "text/xml", nil)
+	})
+}
+
+func share(client management.Client, kind, name, permission string) error {
+	return retry.ExecuteAsyncOperation(client, func() (management.OperationID, error) {
+		return client.SendAzurePutRequest(fmt.Sprintf(shareURL, kind, name, permission), "text/xml", nil)
+	})
+}
+
+func getReplicationProgress(client management.Client, kind, name string) (replicationProgress, error) {
+	var data []byte
+	if err := retry.ExecuteOperation(func() error {
+		var err error
+		data, err = client.SendAzureGetRequest(fmt.Sprintf(detailsURL, kind, name))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return parseReplicationProgress(data)
+}
+
+func parseReplicationProgress(data []byte) (replicationProgress, error) {
+	var details imageDetails
+	if err := xml.Unmarshal(data, &details); err != nil {
+		return nil, err
+	}
+
+	progress := make(replicationProgress)
+	for _, p := range details.ReplicationProgress {
+		percent, err := strconv.Atoi(p.Progress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replication progress %q for location %q", p.Progress, p.Location)
+		}
+		progress[p.Location] = percent
+	}
+	return progress, nil
+}
+
+// complete returns true if all regions have been replicated to.
+func (p replicationProgress) complete(regions []string) bool {
+	for _, r := range regions {
+		if p[r] < 100 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p replicationProgress) String() string {
+	var locations []string
+	for l := range p {
+		locations = append(locations, l)
+	}
+	sort.Strings(locations)
+
+	parts := make([]string, len(locations))
+	for i, l := range locations {
+		parts[i] = fmt.Sprintf("%s %d%%", l, p[l])
+	}
+	return strings.Join(parts, ", ")
+}
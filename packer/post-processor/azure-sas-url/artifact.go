@@ -0,0 +1,45 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azuresasurl
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+)
+
+const BuilderId = "Azure.ServiceManagement.SASURL"
+
+// SASArtifact holds the SAS URLs of the OS and data disk blobs.
+type SASArtifact struct {
+	OSDisk    string
+	DataDisks []string
+	Expiry    string
+}
+
+func (*SASArtifact) BuilderId() string { return BuilderId }
+func (*SASArtifact) Destroy() error    { return nil }
+func (*SASArtifact) Files() []string   { return nil }
+func (a *SASArtifact) Id() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(a.String())))
+}
+func (a *SASArtifact) State(name string) interface{} {
+	switch name {
+	case "osDisk":
+		return a.OSDisk
+	case "dataDisks":
+		return a.DataDisks
+	case "expiry":
+		return a.Expiry
+	default:
+		return nil
+	}
+}
+func (a *SASArtifact) String() string {
+	d, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return string(d)
+}
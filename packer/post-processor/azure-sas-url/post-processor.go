@@ -0,0 +1,177 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azuresasurl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	azureCommon "github.com/Azure/packer-azure/packer/builder/azure/common"
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+	"github.com/Azure/packer-azure/packer/post-processor/azure-sm-vhdonly"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/storage"
+
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/helper/config"
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+var _ packer.PostProcessor = &PostProcessor{}
+
+const (
+	levelBlob      = "blob"
+	levelContainer = "container"
+)
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	Permissions string        `mapstructure:"permissions"`
+	Expiry      time.Duration `mapstructure:"expiry"`
+	Level       string        `mapstructure:"level"`
+	OutputFile  string        `mapstructure:"output_file"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.Permissions == "" {
+		p.config.Permissions = "r"
+	}
+	if p.config.Expiry == 0 {
+		p.config.Expiry = 30 * 24 * time.Hour
+	}
+	if p.config.Level == "" {
+		p.config.Level = levelBlob
+	}
+
+	var errs *packer.MultiError
+
+	for _, r := range p.config.Permissions {
+		if !strings.ContainsRune("rwdl", r) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("permissions %q is not valid, it can only contain r, w, d and l", p.config.Permissions))
+			break
+		}
+	}
+	if p.config.Level != levelBlob && p.config.Level != levelContainer {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("level is not valid, must be one of: %s, %s", levelBlob, levelContainer))
+	}
+	if p.config.Level == levelBlob && strings.ContainsRune(p.config.Permissions, 'l') {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("list permission (l) can only be granted with level %s", levelContainer))
+	}
+	if p.config.Expiry < 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("expiry must be positive"))
+	}
+
+	log.Println(common.ScrubConfig(p.config))
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	ui.Say("Validating artifact")
+	if artifact.BuilderId() != azure.BuilderId && artifact.BuilderId() != azuresmvhdonly.BuilderID {
+		return nil, false, fmt.Errorf(
+			"Unknown artifact type: %s\nCan only create SAS URLs for Azure builder artifacts (%s) or VHD only artifacts (%s).",
+			artifact.BuilderId(), azure.BuilderId, azuresmvhdonly.BuilderID)
+	}
+
+	ui.Message("Creating Azure Service Management client...")
+	client, err := azure.ClientFromArtifact(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ui.Message("Retrieving VHD blobs...")
+	blobs, err := azuresmvhdonly.BlobsFromArtifact(client, artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	expiry := time.Now().Add(p.config.Expiry).UTC()
+	ui.Say(fmt.Sprintf("Creating %s SAS URLs with permissions %q, valid until %s...",
+		p.config.Level, p.config.Permissions, expiry.Format(time.RFC3339)))
+
+	keys := make(map[string]string)
+	result := &SASArtifact{
+		Expiry:    expiry.Format(time.RFC3339),
+		DataDisks: make([]string, len(blobs.DataDisks)),
+	}
+
+	if result.OSDisk, err = p.sasURL(client, keys, blobs.OSDisk, expiry); err != nil {
+		return nil, false, err
+	}
+	for i, d := range blobs.DataDisks {
+		if result.DataDisks[i], err = p.sasURL(client, keys, d, expiry); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if p.config.OutputFile != "" {
+		ui.Message(fmt.Sprintf("Writing SAS URLs to %s...", p.config.OutputFile))
+		if err := ioutil.WriteFile(p.config.OutputFile, []byte(result.String()), 0600); err != nil {
+			return nil, false, fmt.Errorf("Error writing SAS URLs to %s: %v", p.config.OutputFile, err)
+		}
+	}
+
+	return result, true, nil
+}
+
+// sasURL creates a SAS URL for the blob, keys caches the storage account keys
+// that were already retrieved.
+func (p *PostProcessor) sasURL(client management.Client, keys map[string]string, blobURL string, expiry time.Time) (string, error) {
+	errorMsg := "Error creating SAS URL for %s: %v"
+
+	blob, err := azureCommon.ParseBlobURL(blobURL)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, blobURL, err)
+	}
+
+	key, ok := keys[blob.StorageAccount]
+	if !ok {
+		if key, err = azure.StorageAccountKey(client, blob.StorageAccount); err != nil {
+			return "", fmt.Errorf(errorMsg, blobURL, err)
+		}
+		keys[blob.StorageAccount] = key
+	}
+
+	if p.config.Level == levelContainer {
+		sas, err := containerSAS(blob.StorageAccount, key, blob.Container, expiry, p.config.Permissions)
+		if err != nil {
+			return "", fmt.Errorf(errorMsg, blobURL, err)
+		}
+		return blob.URL() + "?" + sas, nil
+	}
+
+	storageClient, err := storage.NewClient(blob.StorageAccount, key, blob.EndpointSuffix, storage.DefaultAPIVersion, true)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, blobURL, err)
+	}
+	sasURL, err := storageClient.GetBlobService().GetBlobSASURI(blob.Container, blob.Blob, expiry, p.config.Permissions)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, blobURL, err)
+	}
+	return sasURL, nil
+}
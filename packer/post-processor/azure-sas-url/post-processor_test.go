@@ -0,0 +1,81 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azuresasurl
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/packer-azure/packer/post-processor/internal/testui"
+	"github.com/mitchellh/packer/packer"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func (s *MySuite) Test_Configure(c *C) {
+	sut := PostProcessor{}
+	c.Assert(sut.Configure(map[string]interface{}{}), IsNil)
+	c.Check(sut.config.Permissions, Equals, "r")
+	c.Check(sut.config.Level, Equals, levelBlob)
+	c.Check(sut.config.Expiry, Equals, 30*24*time.Hour)
+
+	sut = PostProcessor{}
+	c.Assert(sut.Configure(map[string]interface{}{"permissions": "rl", "level": "container", "expiry": "48h"}), IsNil)
+	c.Check(sut.config.Expiry, Equals, 48*time.Hour)
+
+	for _, m := range []map[string]interface{}{
+		{"permissions": "rx"},
+		{"permissions": "rl"},
+		{"level": "account"},
+		{"expiry": "-1h"},
+	} {
+		sut := PostProcessor{}
+		c.Check(sut.Configure(m), NotNil)
+	}
+}
+
+func (s *MySuite) Test_BuilderId(c *C) {
+	a := packer.MockArtifact{BuilderIdValue: "bla"}
+
+	sut := PostProcessor{}
+	_, _, err := sut.PostProcess(testui.New(c), &a)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "Unknown artifact type: bla\n.*")
+}
+
+// serviceSAS has to create the same signature as the storage SDK does for blobs.
+func (s *MySuite) Test_ServiceSASMatchesSDK(c *C) {
+	const key = "dGhpcyBpcyBub3QgYSByZWFsIGtleQ=="
+	expiry := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	client, err := storage.NewClient("account", key, storage.DefaultBaseURL, storage.DefaultAPIVersion, true)
+	c.Assert(err, IsNil)
+	sdkURL, err := client.GetBlobService().GetBlobSASURI("vhds", "disk.vhd", expiry, "r")
+	c.Assert(err, IsNil)
+	u, err := url.Parse(sdkURL)
+	c.Assert(err, IsNil)
+
+	sas, err := serviceSAS("account", key, "/vhds/disk.vhd", "b", expiry, "r")
+	c.Assert(err, IsNil)
+	c.Check(sas, Equals, u.RawQuery)
+
+	sas, err = containerSAS("account", key, "vhds", expiry, "rl")
+	c.Assert(err, IsNil)
+	q, err := url.ParseQuery(sas)
+	c.Assert(err, IsNil)
+	c.Check(q.Get("sr"), Equals, "c")
+	c.Check(q.Get("sp"), Equals, "rl")
+
+	_, err = containerSAS("account", "not base64!", "vhds", expiry, "r")
+	c.Check(err, NotNil)
+}
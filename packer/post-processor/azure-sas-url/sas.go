@@ -0,0 +1,49 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azuresasurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// containerSAS creates the query string of a service SAS for a container.
+// The storage SDK only supports blob level SAS.
+//
+// See https://msdn.microsoft.com/en-us/library/azure/dn140255.aspx
+func containerSAS(account, key, container string, expiry time.Time, permissions string) (string, error) {
+	return serviceSAS(account, key, "/"+container, "c", expiry, permissions)
+}
+
+func serviceSAS(account, key, resource, signedResource string, expiry time.Time, permissions string) (string, error) {
+	const signedVersion = storage.DefaultAPIVersion
+
+	signedExpiry := expiry.UTC().Format(time.RFC3339)
+	canonicalizedResource := fmt.Sprintf("/blob/%s%s", account, resource)
+
+	// signedPermissions, signedStart, signedExpiry, canonicalizedResource,
+	// signedIdentifier, signedVersion, rscc, rscd, rsce, rscl, rsct
+	stringToSign := fmt.Sprintf("%s\n\n%s\n%s\n\n%s\n\n\n\n\n", permissions, signedExpiry, canonicalizedResource, signedVersion)
+
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("storage account key is not valid base64: %v", err)
+	}
+	h := hmac.New(sha256.New, decodedKey)
+	h.Write([]byte(stringToSign))
+
+	return url.Values{
+		"sv":  {signedVersion},
+		"se":  {signedExpiry},
+		"sr":  {signedResource},
+		"sp":  {permissions},
+		"sig": {base64.StdEncoding.EncodeToString(h.Sum(nil))},
+	}.Encode(), nil
+}
@@ -7,24 +7,98 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"strings"
 
+	azureCommon "github.com/Azure/packer-azure/packer/builder/azure/common"
 	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
 	"github.com/Azure/packer-azure/packer/builder/azure/smapi/retry"
 
 	"github.com/Azure/azure-sdk-for-go/management"
 	"github.com/Azure/azure-sdk-for-go/management/virtualmachineimage"
+	"github.com/Azure/azure-sdk-for-go/storage"
 
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
 )
 
 var _ packer.PostProcessor = &PostProcessor{}
 
-const stateError = "Error: Could not retrieve %s for this artifact. Make sure you used the same version of the builder as the post-processor."
+const (
+	osDiskModeRename = "rename"
+	osDiskModeCopy   = "copy"
 
-type PostProcessor struct{}
+	dataDisksKeep   = "keep"
+	dataDisksCopy   = "copy"
+	dataDisksDelete = "delete"
+)
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	OSDiskPath  string `mapstructure:"os_disk_path"`
+	OSDiskMode  string `mapstructure:"os_disk_mode"`
+	DataDisks   string `mapstructure:"data_disks"`
+	KeepVMImage bool   `mapstructure:"keep_vm_image"`
+	OutputFile  string `mapstructure:"output_file"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
 
 func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.OSDiskMode == "" {
+		p.config.OSDiskMode = osDiskModeRename
+	}
+	if p.config.DataDisks == "" {
+		p.config.DataDisks = dataDisksKeep
+	}
+
+	var errs *packer.MultiError
+
+	if p.config.OSDiskMode != osDiskModeRename && p.config.OSDiskMode != osDiskModeCopy {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("os_disk_mode is not valid, must be one of: %s, %s", osDiskModeRename, osDiskModeCopy))
+	}
+	if p.config.DataDisks != dataDisksKeep && p.config.DataDisks != dataDisksCopy && p.config.DataDisks != dataDisksDelete {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("data_disks is not valid, must be one of: %s, %s, %s", dataDisksKeep, dataDisksCopy, dataDisksDelete))
+	}
+	if p.config.OSDiskPath != "" {
+		if parts := strings.SplitN(p.config.OSDiskPath, "/", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("os_disk_path %q is not valid, must be <container>/<blob>", p.config.OSDiskPath))
+		}
+	}
+	if p.config.DataDisks == dataDisksCopy && p.config.OSDiskPath == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("os_disk_path must be specified to copy data disks"))
+	}
+	if p.config.KeepVMImage {
+		// the VHDs of a VM image cannot be removed
+		if p.config.OSDiskPath != "" && p.config.OSDiskMode == osDiskModeRename {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("keep_vm_image cannot be combined with os_disk_mode %s", osDiskModeRename))
+		}
+		if p.config.DataDisks == dataDisksDelete {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("keep_vm_image cannot be combined with data_disks %s", dataDisksDelete))
+		}
+	}
+
+	log.Println(common.ScrubConfig(p.config))
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
 	return nil
 }
 
@@ -36,58 +110,130 @@ func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (pac
 			artifact.BuilderId(), azure.BuilderId)
 	}
 
-	publishSettingsPath, ok := artifact.State("publishSettingsPath").(string)
-	if !ok || publishSettingsPath == "" {
-		return nil, false, fmt.Errorf(stateError, "publishSettingsPath")
+	ui.Message("Creating Azure Service Management client...")
+	client, err := azure.ClientFromArtifact(artifact)
+	if err != nil {
+		return nil, false, err
 	}
-	subscriptionID, ok := artifact.State("subscriptionID").(string)
-	if !ok || subscriptionID == "" {
-		return nil, false, fmt.Errorf(stateError, "subscriptionID")
+
+	ui.Message("Retrieving VHD blobs...")
+	blobs, err := BlobsFromArtifact(client, artifact)
+	if err != nil {
+		return nil, false, err
 	}
 
-	name := artifact.Id()
+	if p.config.KeepVMImage {
+		ui.Message(fmt.Sprintf("Keeping VM image %s", artifact.Id()))
+	} else {
+		ui.Message(fmt.Sprintf("Deleting VM image (keeping VHDs) %s...", artifact.Id()))
+		vmic := virtualmachineimage.NewClient(client)
+		err = retry.ExecuteOperation(func() error { return vmic.DeleteVirtualMachineImage(artifact.Id(), false) })
+		if err != nil {
+			log.Printf("Error deleting VM image: %s", err)
+			return nil, false, err
+		}
+	}
 
-	ui.Message("Creating Azure Service Management client...")
-	client, err := management.ClientFromPublishSettingsFile(publishSettingsPath, subscriptionID)
+	if blobs, err = p.arrangeBlobs(ui, client, blobs); err != nil {
+		return nil, false, err
+	}
+	blobs = NewVMBlobListArtifact(artifact, blobs.OSDisk, blobs.DataDisks)
+
+	if p.config.OutputFile != "" {
+		ui.Message(fmt.Sprintf("Writing blob list to %s...", p.config.OutputFile))
+		if err := ioutil.WriteFile(p.config.OutputFile, []byte(blobs.String()), 0644); err != nil {
+			return nil, false, fmt.Errorf("Error writing blob list to %s: %v", p.config.OutputFile, err)
+		}
+	}
+
+	return blobs, p.config.KeepVMImage, nil
+}
+
+// arrangeBlobs moves or copies the OS disk to os_disk_path and handles the
+// data disks as configured. It returns the resulting blob list.
+func (p *PostProcessor) arrangeBlobs(ui packer.Ui, client management.Client, blobs VMBlobListArtifact) (VMBlobListArtifact, error) {
+	result := VMBlobListArtifact{OSDisk: blobs.OSDisk, DataDisks: blobs.DataDisks}
+	if p.config.OSDiskPath == "" && p.config.DataDisks == dataDisksKeep {
+		return result, nil
+	}
+
+	osDisk, err := azureCommon.ParseBlobURL(blobs.OSDisk)
 	if err != nil {
-		return nil, false, fmt.Errorf("Error creating new Azure client: %v", err)
-	}
-	client = azure.GetLoggedClient(client)
-	vmic := virtualmachineimage.NewClient(client)
-
-	ui.Message("Retrieving VM image...")
-	var image virtualmachineimage.VMImage
-	if err = retry.ExecuteOperation(func() error {
-		imageList, err := vmic.ListVirtualMachineImages(
-			virtualmachineimage.ListParameters{
-				Category: virtualmachineimage.CategoryUser,
-			})
-		if err != nil {
-			return err
+		return result, err
+	}
+	storageClient, err := azure.StorageClientForBlob(client, osDisk)
+	if err != nil {
+		return result, err
+	}
+	blobService := storageClient.GetBlobService()
+
+	if p.config.OSDiskPath != "" {
+		target := blobInAccount(osDisk, p.config.OSDiskPath)
+
+		ui.Message(fmt.Sprintf("Copying OS disk to %s...", target.URL()))
+		if err := copyBlob(blobService, blobs.OSDisk, target); err != nil {
+			return result, fmt.Errorf("Error copying OS disk: %v", err)
 		}
+		if p.config.OSDiskMode == osDiskModeRename {
+			ui.Message(fmt.Sprintf("Deleting original OS disk %s...", blobs.OSDisk))
+			if err := blobService.DeleteBlob(osDisk.Container, osDisk.Blob, nil); err != nil {
+				return result, fmt.Errorf("Error deleting original OS disk: %v", err)
+			}
+		}
+		result.OSDisk = target.URL()
+	}
 
-		for _, i := range imageList.VMImages {
-			if i.Name == name {
-				image = i
-				break
+	switch p.config.DataDisks {
+	case dataDisksCopy:
+		result.DataDisks = make([]string, len(blobs.DataDisks))
+		base := strings.TrimSuffix(p.config.OSDiskPath, ".vhd")
+		for i, d := range blobs.DataDisks {
+			target := blobInAccount(osDisk, fmt.Sprintf("%s-data-%d.vhd", base, i))
+
+			ui.Message(fmt.Sprintf("Copying data disk %d to %s...", i, target.URL()))
+			if err := copyBlob(blobService, d, target); err != nil {
+				return result, fmt.Errorf("Error copying data disk %d: %v", i, err)
 			}
+			result.DataDisks[i] = target.URL()
 		}
-		return nil
-	}); err != nil {
-		log.Printf("VM image client returned error: %s", err)
-		return nil, false, err
+	case dataDisksDelete:
+		for i, d := range blobs.DataDisks {
+			dataDisk, err := azureCommon.ParseBlobURL(d)
+			if err != nil {
+				return result, err
+			}
+			ui.Message(fmt.Sprintf("Deleting data disk %d %s...", i, d))
+			if _, err := blobService.DeleteBlobIfExists(dataDisk.Container, dataDisk.Blob, nil); err != nil {
+				return result, fmt.Errorf("Error deleting data disk %d: %v", i, err)
+			}
+		}
+		result.DataDisks = []string{}
 	}
-	if image.Name != name {
-		return nil, false, fmt.Errorf("Could not find image: %s", name)
+
+	return result, nil
+}
+
+// blobInAccount returns the blob at path, formatted as <container>/<blob>, in
+// the storage account of blob.
+func blobInAccount(blob azureCommon.BlobURL, path string) azureCommon.BlobURL {
+	parts := strings.SplitN(path, "/", 2)
+	return azureCommon.BlobURL{
+		StorageAccount: blob.StorageAccount,
+		EndpointSuffix: blob.EndpointSuffix,
+		Container:      parts[0],
+		Blob:           parts[1],
 	}
+}
 
-	ui.Message(fmt.Sprintf("Deleting VM image (keeping VHDs) %s: %s...", image.Name, image.Label))
-	err = retry.ExecuteOperation(func() error { return vmic.DeleteVirtualMachineImage(image.Name, false) })
-	if err != nil {
-		log.Printf("Error deleting VM image: %s", err)
-		return nil, false, err
+// copyBlob copies a blob within the storage account of the blob service.
+func copyBlob(blobService storage.BlobStorageClient, source string, target azureCommon.BlobURL) error {
+	if _, err := blobService.CreateContainerIfNotExists(target.Container, storage.ContainerAccessTypePrivate); err != nil {
+		return err
 	}
+	return blobService.CopyBlob(target.Container, target.Blob, source)
+}
 
+func blobsFromImage(image virtualmachineimage.VMImage) VMBlobListArtifact {
 	blobs := VMBlobListArtifact{
 		OSDisk:    image.OSDiskConfiguration.MediaLink,
 		DataDisks: make([]string, len(image.DataDiskConfigurations))}
@@ -95,13 +241,74 @@ func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (pac
 	for i, ddc := range image.DataDiskConfigurations {
 		blobs.DataDisks[i] = ddc.MediaLink
 	}
+	return blobs
+}
 
-	return blobs, false, nil
+// BlobsFromArtifact returns the VHD blobs of an Azure builder artifact or
+// of a VM blob list artifact created by this post-processor.
+func BlobsFromArtifact(client management.Client, artifact packer.Artifact) (VMBlobListArtifact, error) {
+	switch artifact.BuilderId() {
+	case azure.BuilderId:
+		if osDisk, ok := artifact.State("osDisk").(string); ok && osDisk != "" {
+			dataDisks, _ := artifact.State("dataDisks").([]string)
+			return VMBlobListArtifact{OSDisk: osDisk, DataDisks: dataDisks}, nil
+		}
+		// artifacts of older builders do not have the disks in their state
+		image, err := azure.FindUserVmImage(client, artifact.Id())
+		if err != nil {
+			return VMBlobListArtifact{}, err
+		}
+		return blobsFromImage(image), nil
+	case BuilderID:
+		osDisk, ok := artifact.State("osDisk").(string)
+		if !ok || osDisk == "" {
+			return VMBlobListArtifact{}, fmt.Errorf("Could not retrieve OS disk for artifact %s", artifact.Id())
+		}
+		dataDisks, _ := artifact.State("dataDisks").([]string)
+		return VMBlobListArtifact{OSDisk: osDisk, DataDisks: dataDisks}, nil
+	default:
+		return VMBlobListArtifact{}, fmt.Errorf("Unknown artifact type: %s", artifact.BuilderId())
+	}
 }
 
 type VMBlobListArtifact struct {
 	OSDisk    string
 	DataDisks []string
+
+	publishSettingsPath string
+	subscriptionID      string
+	provenance          map[string]string
+}
+
+// provenanceKeys are the state values of the builder artifact that describe
+// the build, a VM blob list artifact passes them on.
+var provenanceKeys = []string{
+	"imageName",
+	"imageLabel",
+	"location",
+	"sourceImageName",
+	"sourceImagePublishedDate",
+	"instanceSize",
+	"buildStartTime",
+	"buildEndTime",
+}
+
+// NewVMBlobListArtifact returns the VM blob list artifact of the VHDs of
+// source, with the credentials and the provenance of source.
+func NewVMBlobListArtifact(source packer.Artifact, osDisk string, dataDisks []string) VMBlobListArtifact {
+	a := VMBlobListArtifact{
+		OSDisk:     osDisk,
+		DataDisks:  dataDisks,
+		provenance: make(map[string]string),
+	}
+	a.publishSettingsPath, _ = source.State("publishSettingsPath").(string)
+	a.subscriptionID, _ = source.State("subscriptionID").(string)
+	for _, key := range provenanceKeys {
+		if v, ok := source.State(key).(string); ok {
+			a.provenance[key] = v
+		}
+	}
+	return a
 }
 
 const BuilderID = azure.BuilderId + "-vhdonly"
@@ -112,7 +319,23 @@ func (VMBlobListArtifact) Files() []string   { return nil }
 func (a VMBlobListArtifact) Id() string {
 	return fmt.Sprintf("%x", md5.Sum([]byte(a.String())))
 }
-func (VMBlobListArtifact) State(string) interface{} { return nil }
+func (a VMBlobListArtifact) State(name string) interface{} {
+	switch name {
+	case "osDisk":
+		return a.OSDisk
+	case "dataDisks":
+		return a.DataDisks
+	case "publishSettingsPath":
+		return a.publishSettingsPath
+	case "subscriptionID":
+		return a.subscriptionID
+	default:
+		if v, ok := a.provenance[name]; ok {
+			return v
+		}
+		return nil
+	}
+}
 func (a VMBlobListArtifact) String() string {
 	d, err := json.Marshal(&a)
 	if err != nil {
@@ -4,8 +4,9 @@
 package azuresmvhdonly
 
 import (
-	"errors"
+	azureCommon "github.com/Azure/packer-azure/packer/builder/azure/common"
 	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+	"github.com/Azure/packer-azure/packer/post-processor/internal/testui"
 	"github.com/mitchellh/packer/packer"
 	"strings"
 	"testing"
@@ -20,16 +21,61 @@ type MySuite struct{}
 
 var _ = Suite(&MySuite{})
 
+func (s *MySuite) Test_Configure(c *C) {
+	sut := PostProcessor{}
+	c.Assert(sut.Configure(map[string]interface{}{}), IsNil)
+	c.Check(sut.config.OSDiskMode, Equals, osDiskModeRename)
+	c.Check(sut.config.DataDisks, Equals, dataDisksKeep)
+
+	for _, tc := range []struct {
+		cfg   map[string]interface{}
+		valid bool
+	}{
+		{map[string]interface{}{"os_disk_path": "images/ubuntu.vhd", "data_disks": "copy"}, true},
+		{map[string]interface{}{"os_disk_path": "images/ubuntu.vhd", "os_disk_mode": "copy", "keep_vm_image": true}, true},
+		{map[string]interface{}{"data_disks": "delete", "output_file": "blobs.json"}, true},
+		{map[string]interface{}{"os_disk_path": "ubuntu.vhd"}, false},
+		{map[string]interface{}{"os_disk_mode": "move"}, false},
+		{map[string]interface{}{"data_disks": "copy"}, false},
+		{map[string]interface{}{"data_disks": "archive"}, false},
+		{map[string]interface{}{"os_disk_path": "images/ubuntu.vhd", "keep_vm_image": true}, false},
+		{map[string]interface{}{"data_disks": "delete", "keep_vm_image": true}, false},
+	} {
+		sut := PostProcessor{}
+		err := sut.Configure(tc.cfg)
+		c.Check(err == nil, Equals, tc.valid, Commentf("%v: %v", tc.cfg, err))
+	}
+}
+
+func (s *MySuite) Test_BlobInAccount(c *C) {
+	blob := azureCommon.BlobURL{StorageAccount: "sa", EndpointSuffix: "core.windows.net", Container: "vhds", Blob: "PkrVM.vhd"}
+	c.Check(blobInAccount(blob, "images/ubuntu/latest.vhd").URL(), Equals, "https://sa.blob.core.windows.net/images/ubuntu/latest.vhd")
+}
+
+func (s *MySuite) Test_BlobsFromArtifactState(c *C) {
+	a := packer.MockArtifact{
+		BuilderIdValue: azure.BuilderId,
+		StateValues: map[string]interface{}{
+			"osDisk":    "https://sa.blob.core.windows.net/vhds/os.vhd",
+			"dataDisks": []string{"https://sa.blob.core.windows.net/vhds/data.vhd"},
+		},
+	}
+	blobs, err := BlobsFromArtifact(nil, &a)
+	c.Assert(err, IsNil)
+	c.Check(blobs.OSDisk, Equals, "https://sa.blob.core.windows.net/vhds/os.vhd")
+	c.Check(blobs.DataDisks, DeepEquals, []string{"https://sa.blob.core.windows.net/vhds/data.vhd"})
+}
+
 func (s *MySuite) Test_BuilderId(c *C) {
 	a := packer.MockArtifact{BuilderIdValue: "bla"}
 
 	sut := PostProcessor{}
-	_, _, err := sut.PostProcess(testUi(c), &a)
+	_, _, err := sut.PostProcess(testui.New(c), &a)
 	c.Assert(err, NotNil)
 	c.Assert(strings.Contains(err.Error(), "Can only import from Azure builder"), Equals, true)
 
 	a.BuilderIdValue = azure.BuilderId
-	_, _, err = sut.PostProcess(testUi(c), &a)
+	_, _, err = sut.PostProcess(testui.New(c), &a)
 	c.Assert(err, NotNil)
 	c.Assert(strings.Contains(err.Error(), "Can only import from Azure builder"), Equals, false)
 }
@@ -42,7 +88,7 @@ func (s *MySuite) Test_ArtifactCredentials(c *C) {
 
 	checkErr := func() {
 		sut := PostProcessor{}
-		_, _, err := sut.PostProcess(testUi(c), &a)
+		_, _, err := sut.PostProcess(testui.New(c), &a)
 		c.Assert(err, NotNil)
 		c.Assert(err, ErrorMatches, ".* for this artifact. Make sure you used the same version of the builder as the post-processor.")
 	}
@@ -61,24 +107,3 @@ func (s *MySuite) Test_ArtifactCredentials(c *C) {
 		checkErr()
 	}
 }
-
-func testUi(c *C) *packer.BasicUi {
-	return &packer.BasicUi{
-		Reader:      nilReader{},
-		Writer:      logFunc(func(s string) { c.Logf("UI: %s", s) }),
-		ErrorWriter: logFunc(func(s string) { c.Logf("ERR: %s", s) }),
-	}
-}
-
-type logFunc func(s string)
-
-func (w logFunc) Write(d []byte) (int, error) {
-	w(string(d))
-	return len(d), nil
-}
-
-type nilReader struct{}
-
-func (nilReader) Read([]byte) (int, error) {
-	return 0, errors.New("Nothing to read here, go away.")
-}
@@ -0,0 +1,63 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurevhddownload
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const BuilderId = "Azure.ServiceManagement.VHDDownload"
+
+// VHDDownloadArtifact lists the local paths of the downloaded VHDs and their
+// MD5s by path.
+type VHDDownloadArtifact struct {
+	OSDisk    string
+	DataDisks []string
+	MD5       map[string]string
+}
+
+func (*VHDDownloadArtifact) BuilderId() string { return BuilderId }
+func (a *VHDDownloadArtifact) Destroy() error {
+	for _, f := range a.Files() {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+func (a *VHDDownloadArtifact) Files() []string {
+	var files []string
+	for _, f := range append([]string{a.OSDisk}, a.DataDisks...) {
+		files = append(files, f)
+		if _, ok := a.MD5[f]; ok {
+			files = append(files, md5File(f))
+		}
+	}
+	return files
+}
+func (a *VHDDownloadArtifact) Id() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(a.String())))
+}
+func (a *VHDDownloadArtifact) State(name string) interface{} {
+	switch name {
+	case "osDisk":
+		return a.OSDisk
+	case "dataDisks":
+		return a.DataDisks
+	case "md5":
+		return a.MD5
+	default:
+		return nil
+	}
+}
+func (a *VHDDownloadArtifact) String() string {
+	d, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return string(d)
+}
@@ -0,0 +1,286 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurevhddownload
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+)
+
+// pageBlobReader is the subset of storage.BlobStorageClient that is needed
+// to download a page blob.
+type pageBlobReader interface {
+	GetBlobProperties(container, name string) (*storage.BlobProperties, error)
+	GetPageRanges(container, name string) (storage.GetPageRangesResponse, error)
+	GetBlobRange(container, name, bytesRange string) (io.ReadCloser, error)
+}
+
+// chunk is a range of bytes of the blob, End is inclusive.
+type chunk struct {
+	Start int64
+	End   int64
+}
+
+// splitPageRanges splits the valid page ranges of a blob into chunks of at
+// most chunkSize bytes.
+func splitPageRanges(ranges []storage.PageRange, chunkSize int64) []chunk {
+	var chunks []chunk
+	for _, r := range ranges {
+		for start := r.Start; start <= r.End; start += chunkSize {
+			end := start + chunkSize - 1
+			if end > r.End {
+				end = r.End
+			}
+			chunks = append(chunks, chunk{start, end})
+		}
+	}
+	return chunks
+}
+
+// downloadProgress is stored next to the downloaded file so that an
+// interrupted download can be resumed.
+type downloadProgress struct {
+	Etag          string
+	ContentLength int64
+	Completed     []int64
+
+	completed map[int64]bool
+	path      string
+	mu        sync.Mutex
+}
+
+func progressFile(path string) string {
+	return path + ".progress"
+}
+
+// loadProgress loads the progress of a previous download of the same blob
+// version, or returns an empty progress.
+func loadProgress(path string, props *storage.BlobProperties) *downloadProgress {
+	p := &downloadProgress{
+		Etag:          props.Etag,
+		ContentLength: props.ContentLength,
+		completed:     make(map[int64]bool),
+		path:          progressFile(path),
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return p
+	}
+	d, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return p
+	}
+
+	var previous downloadProgress
+	if err := json.Unmarshal(d, &previous); err != nil {
+		log.Printf("Ignoring invalid progress file %s: %v", p.path, err)
+		return p
+	}
+	if previous.Etag != props.Etag || previous.ContentLength != props.ContentLength {
+		log.Printf("Blob changed since the previous download, starting over")
+		return p
+	}
+	for _, start := range previous.Completed {
+		p.completed[start] = true
+	}
+	p.Completed = previous.Completed
+	return p
+}
+
+func (p *downloadProgress) isCompleted(c chunk) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.completed[c.Start]
+}
+
+func (p *downloadProgress) complete(c chunk) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completed[c.Start] = true
+	p.Completed = append(p.Completed, c.Start)
+	d, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.path, d, 0644)
+}
+
+func (p *downloadProgress) remove() error {
+	return os.Remove(p.path)
+}
+
+// downloadResult is the MD5 of a downloaded file, Verified is set if it
+// matched the Content-MD5 of the blob.
+type downloadResult struct {
+	MD5      string
+	Verified bool
+}
+
+// downloadPageBlob downloads the valid page ranges of a page blob into a
+// sparse file at path, using parallelism concurrent requests. Chunks that
+// were downloaded by a previous, interrupted call are skipped.
+func downloadPageBlob(blobs pageBlobReader, container, name, path string, chunkSize int64, parallelism int, requireMD5 bool, report func(done, total int64)) (downloadResult, error) {
+	props, err := blobs.GetBlobProperties(container, name)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	if requireMD5 && props.ContentMD5 == "" {
+		return downloadResult{}, fmt.Errorf("blob has no Content-MD5 to verify the download against")
+	}
+	ranges, err := blobs.GetPageRanges(container, name)
+	if err != nil {
+		return downloadResult{}, err
+	}
+
+	progress := loadProgress(path, props)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	defer f.Close()
+
+	// Truncate creates a sparse file on file systems that support it, only
+	// the valid page ranges are written. Data of a previous download is only
+	// kept when it is resumed.
+	if len(progress.Completed) == 0 {
+		if err := f.Truncate(0); err != nil {
+			return downloadResult{}, err
+		}
+	}
+	if err := f.Truncate(props.ContentLength); err != nil {
+		return downloadResult{}, err
+	}
+
+	chunks := splitPageRanges(ranges.PageList, chunkSize)
+	var total, done int64
+	for _, c := range chunks {
+		total += c.End - c.Start + 1
+		if progress.isCompleted(c) {
+			done += c.End - c.Start + 1
+		}
+	}
+	if done > 0 {
+		log.Printf("Resuming download of %s, %d of %d bytes already downloaded", name, done, total)
+	}
+
+	work := make(chan chunk)
+	errs := make(chan error, parallelism)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				if err := downloadChunk(blobs, container, name, f, c); err != nil {
+					errs <- err
+					return
+				}
+				if err := progress.complete(c); err != nil {
+					errs <- err
+					return
+				}
+				mu.Lock()
+				done += c.End - c.Start + 1
+				report(done, total)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var firstErr error
+Chunks:
+	for _, c := range chunks {
+		if progress.isCompleted(c) {
+			continue
+		}
+		select {
+		case work <- c:
+		case firstErr = <-errs:
+			break Chunks
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr == nil {
+		select {
+		case firstErr = <-errs:
+		default:
+		}
+	}
+	if firstErr != nil {
+		return downloadResult{}, firstErr
+	}
+
+	if err := f.Sync(); err != nil {
+		return downloadResult{}, err
+	}
+	if err := progress.remove(); err != nil && !os.IsNotExist(err) {
+		return downloadResult{}, err
+	}
+	return verifyDownload(f, props)
+}
+
+func downloadChunk(blobs pageBlobReader, container, name string, f *os.File, c chunk) error {
+	body, err := blobs.GetBlobRange(container, name, fmt.Sprintf("%d-%d", c.Start, c.End))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != c.End-c.Start+1 {
+		return fmt.Errorf("received %d bytes for range %d-%d", len(data), c.Start, c.End)
+	}
+
+	_, err = f.WriteAt(data, c.Start)
+	return err
+}
+
+// verifyDownload checks the size of the downloaded file and computes its
+// MD5, which is compared with the Content-MD5 of the blob if it has one.
+func verifyDownload(f *os.File, props *storage.BlobProperties) (downloadResult, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return downloadResult{}, err
+	}
+	if fi.Size() != props.ContentLength {
+		return downloadResult{}, fmt.Errorf("downloaded file size %d does not match blob size %d", fi.Size(), props.ContentLength)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return downloadResult{}, err
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return downloadResult{}, err
+	}
+	result := downloadResult{MD5: hex.EncodeToString(h.Sum(nil))}
+
+	if props.ContentMD5 == "" {
+		log.Printf("Blob has no Content-MD5, MD5 of %s not verified", f.Name())
+		return result, nil
+	}
+	if md5sum := base64.StdEncoding.EncodeToString(h.Sum(nil)); md5sum != props.ContentMD5 {
+		return downloadResult{}, fmt.Errorf("MD5 of downloaded file %s does not match blob MD5 %s", md5sum, props.ContentMD5)
+	}
+	result.Verified = true
+	return result, nil
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurevhddownload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	azureCommon "github.com/Azure/packer-azure/packer/builder/azure/common"
+	azure "github.com/Azure/packer-azure/packer/builder/azure/smapi"
+	"github.com/Azure/packer-azure/packer/post-processor/azure-sm-vhdonly"
+
+	"github.com/Azure/azure-sdk-for-go/management"
+	"github.com/Azure/azure-sdk-for-go/storage"
+
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/helper/config"
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+var _ packer.PostProcessor = &PostProcessor{}
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	OutputDirectory string `mapstructure:"output_directory"`
+	Parallelism     int    `mapstructure:"parallelism"`
+	ChunkSize       int64  `mapstructure:"chunk_size"`
+	VerifyMD5       bool   `mapstructure:"verify_md5"`
+
+	ctx interpolate.Context
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	if p.config.OutputDirectory == "" {
+		p.config.OutputDirectory = fmt.Sprintf("output-%s", p.config.PackerBuildName)
+	}
+	if p.config.Parallelism == 0 {
+		p.config.Parallelism = 4
+	}
+	if p.config.ChunkSize == 0 {
+		p.config.ChunkSize = storage.MaxBlobPageSize
+	}
+
+	var errs *packer.MultiError
+
+	if p.config.Parallelism < 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("parallelism must be positive"))
+	}
+	if p.config.ChunkSize < 0 || p.config.ChunkSize%512 != 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("chunk_size must be a positive multiple of 512"))
+	}
+
+	log.Println(common.ScrubConfig(p.config))
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	ui.Say("Validating artifact")
+	if artifact.BuilderId() != azure.BuilderId && artifact.BuilderId() != azuresmvhdonly.BuilderID {
+		return nil, false, fmt.Errorf(
+			"Unknown artifact type: %s\nCan only download VHDs of Azure builder artifacts (%s) or VHD only artifacts (%s).",
+			artifact.BuilderId(), azure.BuilderId, azuresmvhdonly.BuilderID)
+	}
+
+	ui.Message("Creating Azure Service Management client...")
+	client, err := azure.ClientFromArtifact(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ui.Message("Retrieving VHD blobs...")
+	blobs, err := azuresmvhdonly.BlobsFromArtifact(client, artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := os.MkdirAll(p.config.OutputDirectory, 0755); err != nil {
+		return nil, false, fmt.Errorf("Error creating output directory %s: %v", p.config.OutputDirectory, err)
+	}
+
+	result := &VHDDownloadArtifact{
+		DataDisks: make([]string, len(blobs.DataDisks)),
+		MD5:       make(map[string]string),
+	}
+
+	if result.OSDisk, err = p.download(ui, client, blobs.OSDisk, result.MD5); err != nil {
+		return nil, false, err
+	}
+	for i, d := range blobs.DataDisks {
+		if result.DataDisks[i], err = p.download(ui, client, d, result.MD5); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return result, true, nil
+}
+
+// download downloads the blob into the output directory and returns the
+// path of the local file. The MD5 of the file is added to md5s and written
+// to a .md5 file next to it.
+func (p *PostProcessor) download(ui packer.Ui, client management.Client, blobURL string, md5s map[string]string) (string, error) {
+	errorMsg := "Error downloading %s: %v"
+
+	blob, err := azureCommon.ParseBlobURL(blobURL)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, blobURL, err)
+	}
+
+	storageClient, err := azure.StorageClientForBlob(client, blob)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, blobURL, err)
+	}
+
+	localPath := filepath.Join(p.config.OutputDirectory, path.Base(blob.Blob))
+	ui.Say(fmt.Sprintf("Downloading %s to %s...", blobURL, localPath))
+
+	lastPercent := int64(-1)
+	report := func(done, total int64) {
+		if total == 0 {
+			return
+		}
+		if percent := done * 100 / total; percent/10 != lastPercent/10 {
+			lastPercent = percent
+			ui.Message(fmt.Sprintf("Download progress: %d%% (%d/%d bytes)", percent, done, total))
+		}
+	}
+
+	result, err := downloadPageBlob(storageClient.GetBlobService(), blob.Container, blob.Blob, localPath,
+		p.config.ChunkSize, p.config.Parallelism, p.config.VerifyMD5, report)
+	if err != nil {
+		return "", fmt.Errorf(errorMsg, blobURL, err)
+	}
+
+	if result.Verified {
+		ui.Message(fmt.Sprintf("MD5 %s matches the Content-MD5 of the blob", result.MD5))
+	} else {
+		ui.Message(fmt.Sprintf("MD5 %s not verified, the blob has no Content-MD5", result.MD5))
+	}
+	md5s[localPath] = result.MD5
+	if err := writeMD5File(localPath, result.MD5); err != nil {
+		return "", fmt.Errorf("Error writing MD5 of %s: %v", localPath, err)
+	}
+	return localPath, nil
+}
+
+func md5File(path string) string {
+	return path + ".md5"
+}
+
+// writeMD5File writes the MD5 of the file at path in the format of md5sum.
+func writeMD5File(path, md5sum string) error {
+	return ioutil.WriteFile(md5File(path), []byte(fmt.Sprintf("%s  %s\n", md5sum, filepath.Base(path))), 0644)
+}
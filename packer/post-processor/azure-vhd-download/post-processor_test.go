@@ -0,0 +1,189 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+package azurevhddownload
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+
+	"github.com/Azure/packer-azure/packer/post-processor/internal/testui"
+
+	"github.com/mitchellh/packer/packer"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type MySuite struct{}
+
+var _ = Suite(&MySuite{})
+
+func (s *MySuite) Test_Configure(c *C) {
+	sut := PostProcessor{}
+	c.Assert(sut.Configure(map[string]interface{}{"packer_build_name": "azure"}), IsNil)
+	c.Check(sut.config.OutputDirectory, Equals, "output-azure")
+	c.Check(sut.config.Parallelism, Equals, 4)
+	c.Check(sut.config.ChunkSize, Equals, int64(storage.MaxBlobPageSize))
+
+	sut = PostProcessor{}
+	c.Check(sut.Configure(map[string]interface{}{"chunk_size": 1000}), NotNil)
+	sut = PostProcessor{}
+	c.Check(sut.Configure(map[string]interface{}{"parallelism": -1}), NotNil)
+}
+
+func (s *MySuite) Test_BuilderId(c *C) {
+	a := packer.MockArtifact{BuilderIdValue: "bla"}
+
+	sut := PostProcessor{}
+	_, _, err := sut.PostProcess(testui.New(c), &a)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "Unknown artifact type: bla\n.*")
+}
+
+func (s *MySuite) Test_SplitPageRanges(c *C) {
+	chunks := splitPageRanges([]storage.PageRange{{Start: 0, End: 1535}, {Start: 4096, End: 4607}}, 1024)
+	c.Check(chunks, DeepEquals, []chunk{{0, 1023}, {1024, 1535}, {4096, 4607}})
+}
+
+func (s *MySuite) Test_DownloadPageBlob(c *C) {
+	blob := newFakePageBlob(8192, []storage.PageRange{{Start: 0, End: 1535}, {Start: 4096, End: 4607}})
+	path := filepath.Join(c.MkDir(), "disk.vhd")
+
+	result, err := downloadPageBlob(blob, "vhds", "disk.vhd", path, 512, 2, false, func(int64, int64) {})
+	c.Assert(err, IsNil)
+	c.Check(blob.requests, Equals, 4)
+	c.Check(result, DeepEquals, downloadResult{MD5: fmt.Sprintf("%x", md5.Sum(blob.data)), Verified: true})
+
+	d, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(d, blob.data), Equals, true)
+
+	_, err = os.Stat(progressFile(path))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *MySuite) Test_DownloadPageBlob_Resume(c *C) {
+	blob := newFakePageBlob(8192, []storage.PageRange{{Start: 0, End: 1535}, {Start: 4096, End: 4607}})
+	path := filepath.Join(c.MkDir(), "disk.vhd")
+
+	blob.failAt = 1024
+	_, err := downloadPageBlob(blob, "vhds", "disk.vhd", path, 512, 1, false, func(int64, int64) {})
+	c.Assert(err, NotNil)
+	_, err = os.Stat(progressFile(path))
+	c.Assert(err, IsNil)
+
+	blob.failAt = -1
+	blob.requests = 0
+	var done, total int64
+	_, err = downloadPageBlob(blob, "vhds", "disk.vhd", path, 512, 1, false, func(d, t int64) { done, total = d, t })
+	c.Assert(err, IsNil)
+	c.Check(blob.requests, Equals, 2)
+	c.Check(done, Equals, int64(2048))
+	c.Check(total, Equals, int64(2048))
+
+	d, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(d, blob.data), Equals, true)
+}
+
+func (s *MySuite) Test_DownloadPageBlob_MD5Mismatch(c *C) {
+	blob := newFakePageBlob(4096, []storage.PageRange{{Start: 0, End: 511}})
+	blob.props.ContentMD5 = base64.StdEncoding.EncodeToString(make([]byte, md5.Size))
+	path := filepath.Join(c.MkDir(), "disk.vhd")
+
+	_, err := downloadPageBlob(blob, "vhds", "disk.vhd", path, 512, 1, false, func(int64, int64) {})
+	c.Check(err, ErrorMatches, "MD5 of downloaded file .* does not match blob MD5 .*")
+}
+
+func (s *MySuite) Test_DownloadPageBlob_NoContentMD5(c *C) {
+	blob := newFakePageBlob(4096, []storage.PageRange{{Start: 0, End: 511}})
+	blob.props.ContentMD5 = ""
+	path := filepath.Join(c.MkDir(), "disk.vhd")
+
+	result, err := downloadPageBlob(blob, "vhds", "disk.vhd", path, 512, 1, false, func(int64, int64) {})
+	c.Assert(err, IsNil)
+	c.Check(result, DeepEquals, downloadResult{MD5: fmt.Sprintf("%x", md5.Sum(blob.data))})
+
+	_, err = downloadPageBlob(blob, "vhds", "disk.vhd", path, 512, 1, true, func(int64, int64) {})
+	c.Check(err, ErrorMatches, "blob has no Content-MD5 .*")
+}
+
+func (s *MySuite) Test_WriteMD5File(c *C) {
+	path := filepath.Join(c.MkDir(), "disk.vhd")
+	c.Assert(writeMD5File(path, "d41d8cd98f00b204e9800998ecf8427e"), IsNil)
+
+	d, err := ioutil.ReadFile(md5File(path))
+	c.Assert(err, IsNil)
+	c.Check(string(d), Equals, "d41d8cd98f00b204e9800998ecf8427e  disk.vhd\n")
+
+	a := &VHDDownloadArtifact{OSDisk: path, MD5: map[string]string{path: "d41d8cd98f00b204e9800998ecf8427e"}}
+	c.Check(a.Files(), DeepEquals, []string{path, md5File(path)})
+}
+
+// fakePageBlob serves a page blob whose data is non-zero in the valid
+// ranges only.
+type fakePageBlob struct {
+	data     []byte
+	ranges   []storage.PageRange
+	props    storage.BlobProperties
+	failAt   int64
+	requests int
+	mu       sync.Mutex
+}
+
+func newFakePageBlob(size int64, ranges []storage.PageRange) *fakePageBlob {
+	data := make([]byte, size)
+	for _, r := range ranges {
+		for i := r.Start; i <= r.End; i++ {
+			data[i] = byte(i%251 + 1)
+		}
+	}
+	sum := md5.Sum(data)
+	return &fakePageBlob{
+		data:   data,
+		ranges: ranges,
+		failAt: -1,
+		props: storage.BlobProperties{
+			Etag:          "0x1",
+			ContentLength: size,
+			ContentMD5:    base64.StdEncoding.EncodeToString(sum[:]),
+		},
+	}
+}
+
+func (b *fakePageBlob) GetBlobProperties(container, name string) (*storage.BlobProperties, error) {
+	props := b.props
+	return &props, nil
+}
+
+func (b *fakePageBlob) GetPageRanges(container, name string) (storage.GetPageRangesResponse, error) {
+	return storage.GetPageRangesResponse{PageList: b.ranges}, nil
+}
+
+func (b *fakePageBlob) GetBlobRange(container, name, bytesRange string) (io.ReadCloser, error) {
+	var start, end int64
+	if _, err := fmt.Sscanf(bytesRange, "%d-%d", &start, &end); err != nil {
+		return nil, err
+	}
+	if start == b.failAt {
+		return nil, errors.New("connection reset")
+	}
+	b.mu.Lock()
+	b.requests++
+	b.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(b.data[start : end+1])), nil
+}
@@ -0,0 +1,41 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License. See the LICENSE file in the project root for license information.
+
+// Package testui provides the packer.Ui that the post-processor tests run
+// with.
+package testui
+
+import (
+	"errors"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// Logger is the part of the test context the Ui writes to, e.g. a
+// *check.C or a *testing.T.
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+// New returns a Ui that logs its output to the test, and cannot read any
+// input.
+func New(l Logger) *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader:      nilReader{},
+		Writer:      logFunc(func(s string) { l.Logf("UI: %s", s) }),
+		ErrorWriter: logFunc(func(s string) { l.Logf("ERR: %s", s) }),
+	}
+}
+
+type logFunc func(s string)
+
+func (w logFunc) Write(d []byte) (int, error) {
+	w(string(d))
+	return len(d), nil
+}
+
+type nilReader struct{}
+
+func (nilReader) Read([]byte) (int, error) {
+	return 0, errors.New("Nothing to read here, go away.")
+}